@@ -0,0 +1,384 @@
+package goqueue
+
+import "time"
+
+// Priority is the scheduling priority of a submitted function. Backlogged
+// functions with a higher priority are started before those with a lower
+// priority, unless the Queue ages them (see WithAging); functions with
+// equal priority are started in FIFO order.
+type Priority int
+
+// Priority levels accepted by AddPriority. The zero value is
+// PriorityNormal.
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+
+	numPriorities = int(PriorityHigh-PriorityLow) + 1
+)
+
+// index returns the position of p's list in a backlog.
+func (p Priority) index() int {
+	return int(p - PriorityLow)
+}
+
+// clamp returns p limited to the range of defined priority levels.
+func (p Priority) clamp() Priority {
+	if p < PriorityLow {
+		return PriorityLow
+	}
+	if p > PriorityHigh {
+		return PriorityHigh
+	}
+	return p
+}
+
+// Ordering selects which of the backlogged functions of equal priority is
+// started first.
+type Ordering int
+
+// Orderings accepted by WithOrdering. The zero value is FIFO.
+const (
+	// FIFO starts the function that has waited longest.
+	FIFO Ordering = iota
+	// LIFO starts the function that was submitted most recently.
+	LIFO
+)
+
+// taskList is a doubly linked list of tasks, linked through their prev
+// and next fields so that backlogging a task allocates nothing.
+type taskList struct {
+	front, back *task
+}
+
+// pushBack appends t to l.
+func (l *taskList) pushBack(t *task) {
+	t.prev, t.next = l.back, nil
+	if l.back != nil {
+		l.back.next = t
+	} else {
+		l.front = t
+	}
+	l.back = t
+}
+
+// remove unlinks t, which must be in l.
+func (l *taskList) remove(t *task) {
+	if t.prev != nil {
+		t.prev.next = t.next
+	} else {
+		l.front = t.next
+	}
+	if t.next != nil {
+		t.next.prev = t.prev
+	} else {
+		l.back = t.prev
+	}
+	t.prev, t.next = nil, nil
+}
+
+// backlog holds the tasks waiting for a slot, in one list per priority
+// level ordered by submission. Since the lists are intrusive, a backlog
+// has no capacity to reserve: it grows without reallocating, however many
+// tasks are submitted at once.
+type backlog struct {
+	lists    [numPriorities]taskList
+	n        int
+	keys     map[string]*task              // backlogged tasks submitted with AddUnique
+	labels   map[string]map[*task]struct{} // backlogged tasks by label
+	ordering Ordering
+
+	// aging, if positive, is how long a task waits to be promoted one
+	// priority level; see WithAging.
+	aging time.Duration
+	clock Clock
+
+	// sched, if non-nil, orders the tasks instead of lists, ordering and
+	// aging; see scheduler.go.
+	sched       Scheduler
+	all         taskList // every task, in submission order
+	unscheduled *task    // first task of all not yet handed to sched
+	head        *task    // task popped from sched but still backlogged
+
+	// Tasks of a generation later than gen are held back by a Barrier;
+	// ready counts the backlogged tasks that are not.
+	gen   int64
+	ready int
+
+	// events, if non-nil, holds the most recent length not yet received
+	// by the subscriber to BacklogEvents.
+	events chan int64
+
+	// shrunk, if non-nil, is closed the next time a task is removed, to
+	// wake callers of WaitBacklogBelow.
+	shrunk chan struct{}
+
+	collector Collector // nil if the Queue has no Collector
+
+	// onExceed, if non-nil, is called when the length grows past
+	// threshold; above records whether it is currently past it.
+	onExceed  func(len int64)
+	threshold int
+	above     bool
+}
+
+// newBacklog returns an empty backlog configured by o.
+func newBacklog(o *options) *backlog {
+	return &backlog{
+		ordering:  o.ordering,
+		aging:     o.aging,
+		clock:     o.clock,
+		sched:     o.scheduler,
+		collector: o.hooks.collector,
+		onExceed:  o.onExceed,
+		threshold: o.threshold,
+	}
+}
+
+// len returns the number of tasks in b.
+func (b *backlog) len() int {
+	return b.n
+}
+
+// push appends t to the end of the list for its priority.
+func (b *backlog) push(t *task) {
+	t.backlogged = true
+	if b.sched != nil {
+		b.schedPush(t)
+	} else {
+		b.lists[t.priority.index()].pushBack(t)
+	}
+	b.n++
+	if t.gen <= b.gen {
+		b.ready++
+	}
+	if x := t.x; x != nil {
+		if x.unique {
+			if b.keys == nil {
+				b.keys = make(map[string]*task)
+			}
+			b.keys[x.key] = t
+		}
+		if x.label != "" {
+			if b.labels == nil {
+				b.labels = make(map[string]map[*task]struct{})
+			}
+			set := b.labels[x.label]
+			if set == nil {
+				set = make(map[*task]struct{})
+				b.labels[x.label] = set
+			}
+			set[t] = struct{}{}
+		}
+	}
+	b.notify()
+}
+
+// hasKey reports whether b holds a task submitted with AddUnique for key.
+func (b *backlog) hasKey(key string) bool {
+	_, ok := b.keys[key]
+	return ok
+}
+
+// peek returns the next task of the highest priority according to b's
+// ordering, or nil if b is empty.
+func (b *backlog) peek() *task {
+	if b.sched != nil {
+		return b.schedPeek()
+	}
+	for p := numPriorities - 1; p >= 0; p-- {
+		t := b.lists[p].front
+		if b.ordering == LIFO {
+			t = b.lists[p].back
+		}
+		if t != nil {
+			return t
+		}
+	}
+	return nil
+}
+
+// peekReady is like peek, but ignores tasks held back by a Barrier.
+func (b *backlog) peekReady() *task {
+	if b.ready == 0 {
+		return nil
+	}
+	if b.sched != nil {
+		// Only ready tasks are handed to the Scheduler, so unless it
+		// has none left, this is one of them.
+		if t := b.schedPeek(); t != nil && t.gen <= b.gen {
+			return t
+		}
+		return nil
+	}
+	if b.aging > 0 {
+		return b.peekAged()
+	}
+	for p := numPriorities - 1; p >= 0; p-- {
+		if b.ordering == LIFO {
+			t := b.lists[p].back
+			for t != nil && t.gen > b.gen {
+				t = t.prev
+			}
+			if t != nil {
+				return t
+			}
+			continue
+		}
+		// Generations only grow, so a list's oldest task is ready if
+		// any of its tasks is.
+		if t := b.lists[p].front; t != nil && t.gen <= b.gen {
+			return t
+		}
+	}
+	return nil
+}
+
+// peekAged is peekReady for a backlog with aging. Each list's next ready
+// task competes at its own level, except that the list's oldest task
+// competes instead if its age promotes it above that level.
+func (b *backlog) peekAged() *task {
+	now := b.clock.Now()
+	var best *task
+	bestLevel := int64(-1)
+	for p := numPriorities - 1; p >= 0; p-- {
+		l := &b.lists[p]
+		// Generations only grow, so the oldest task is ready if any is.
+		oldest := l.front
+		if oldest == nil || oldest.gen > b.gen {
+			continue
+		}
+		t, level := oldest, int64(p)
+		if b.ordering == LIFO {
+			t = l.back
+			for t.gen > b.gen {
+				t = t.prev
+			}
+		}
+		if promoted := int64(p) + int64(now.Sub(oldest.since)/b.aging); promoted > level {
+			t, level = oldest, promoted
+		}
+		if level > bestLevel {
+			best, bestLevel = t, level
+		}
+	}
+	return best
+}
+
+// release makes the tasks of generation gen and earlier ready.
+func (b *backlog) release(gen int64) {
+	if b.sched != nil {
+		b.schedRelease(gen)
+	}
+	b.gen = gen
+	b.ready = 0
+	b.each(func(t *task) {
+		if t.gen <= gen {
+			b.ready++
+		}
+	})
+}
+
+// pop removes and returns the task peek would return, or nil if b is
+// empty.
+func (b *backlog) pop() *task {
+	t := b.peek()
+	if t != nil {
+		b.remove(t)
+	}
+	return t
+}
+
+// each calls f for each task in b, in the order in which pop would return
+// them, or in submission order if b has a Scheduler.
+func (b *backlog) each(f func(*task)) {
+	if b.sched != nil {
+		// Only the Scheduler knows its order.
+		for t := b.all.front; t != nil; t = t.next {
+			f(t)
+		}
+		return
+	}
+	for p := numPriorities - 1; p >= 0; p-- {
+		l := &b.lists[p]
+		if b.ordering == LIFO {
+			for t := l.back; t != nil; t = t.prev {
+				f(t)
+			}
+			continue
+		}
+		for t := l.front; t != nil; t = t.next {
+			f(t)
+		}
+	}
+}
+
+// labeled returns the tasks in b with the given label, in no particular
+// order.
+func (b *backlog) labeled(label string) []*task {
+	set := b.labels[label]
+	ts := make([]*task, 0, len(set))
+	for t := range set {
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+// remove removes t from b and reports whether it was present.
+func (b *backlog) remove(t *task) bool {
+	if !t.backlogged {
+		return false
+	}
+	if b.sched != nil {
+		b.schedRemove(t)
+	} else {
+		b.lists[t.priority.index()].remove(t)
+	}
+	t.backlogged = false
+	b.n--
+	if t.gen <= b.gen {
+		b.ready--
+	}
+	if x := t.x; x != nil {
+		if x.unique {
+			delete(b.keys, x.key)
+		}
+		if x.label != "" {
+			set := b.labels[x.label]
+			delete(set, t)
+			if len(set) == 0 {
+				delete(b.labels, x.label)
+			}
+		}
+	}
+	if b.shrunk != nil {
+		close(b.shrunk)
+		b.shrunk = nil
+	}
+	b.notify()
+	return true
+}
+
+// notify reports b's length to the Collector, if any, and publishes it to
+// the events channel, replacing any value the subscriber has not yet
+// received.
+func (b *backlog) notify() {
+	if b.collector != nil {
+		b.collector.SetBacklog(b.n)
+	}
+	if b.onExceed != nil {
+		if b.n > b.threshold && !b.above {
+			go b.onExceed(int64(b.n))
+		}
+		b.above = b.n > b.threshold
+	}
+	if b.events == nil {
+		return
+	}
+	select {
+	case <-b.events:
+	default:
+	}
+	b.events <- int64(b.n)
+}
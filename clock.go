@@ -0,0 +1,79 @@
+package goqueue
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// A Clock supplies the current time and timers to a Queue. The Queue uses
+// its Clock for AddAfter delays, AddWithTimeout timeouts, wait timeouts,
+// rate limiting and the timings it reports, so that tests can control
+// them. Deadlines on submitted contexts are always measured in real time.
+//
+// The default Clock uses the time package.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// A Timer is a single-shot timer created by a Clock. It has the same
+// meaning as a *time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered when the
+	// timer fires.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It returns false if the timer
+	// has already fired or been stopped.
+	Stop() bool
+}
+
+// realClock is the default Clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct{ t *time.Timer }
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+
+func (t realTimer) Stop() bool { return t.t.Stop() }
+
+// withTimeout is like context.WithTimeout, but measures timeout on clock.
+// With the real clock it is context.WithTimeout; otherwise the returned
+// context has no deadline, but is cancelled by a timer, after which its
+// Err reports context.DeadlineExceeded.
+func withTimeout(ctx context.Context, clock Clock, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := clock.(realClock); ok {
+		return context.WithTimeout(ctx, timeout)
+	}
+	inner, cancel := context.WithCancel(ctx)
+	c := &timeoutContext{Context: inner}
+	timer := clock.NewTimer(timeout)
+	go func() {
+		select {
+		case <-timer.C():
+			c.expired.Store(true)
+			cancel()
+		case <-inner.Done():
+			timer.Stop()
+		}
+	}()
+	return c, cancel
+}
+
+// timeoutContext is a context cancelled by withTimeout's timer.
+type timeoutContext struct {
+	context.Context
+	expired atomic.Bool // set before the timer cancels the context
+}
+
+func (c *timeoutContext) Err() error {
+	err := c.Context.Err()
+	if err != nil && c.expired.Load() {
+		return context.DeadlineExceeded
+	}
+	return err
+}
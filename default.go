@@ -0,0 +1,72 @@
+package goqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+)
+
+// The default Queue, used by Go and Wait, is created on first use.
+var (
+	defaultMu        sync.Mutex // guards defaultMaxActive and defaultQueue
+	defaultMaxActive int        // 0 means runtime.GOMAXPROCS(0)
+	defaultQueue     *Queue
+)
+
+// errDefaultStarted is returned by SetDefaultMaxActive once the default
+// Queue has been created.
+var errDefaultStarted = errors.New("goqueue: default queue already in use")
+
+// defaultQ returns the default Queue, creating it if necessary.
+func defaultQ() *Queue {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultQueue == nil {
+		n := defaultMaxActive
+		if n == 0 {
+			n = runtime.GOMAXPROCS(0)
+		}
+		defaultQueue, _ = NewQueue(n)
+	}
+	return defaultQueue
+}
+
+// resetDefault forgets the default Queue and its limit, so that tests can
+// start from a fresh one. Functions already submitted to it still run.
+func resetDefault() {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	defaultQueue = nil
+	defaultMaxActive = 0
+}
+
+// SetDefaultMaxActive sets the concurrency limit of the default Queue used
+// by Go and Wait. It must be called before either is first used, and
+// returns an error otherwise or if n is less than 1. The default limit is
+// runtime.GOMAXPROCS(0) at the time of first use.
+func SetDefaultMaxActive(n int) error {
+	if n < 1 {
+		return fmt.Errorf("goQueue called with nonpositive limit (%d)", n)
+	}
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+	if defaultQueue != nil {
+		return errDefaultStarted
+	}
+	defaultMaxActive = n
+	return nil
+}
+
+// Go submits f to the default Queue, as by Add. It suits small programs
+// that need only one Queue; anything more should create its own.
+func Go(ctx context.Context, f func(context.Context)) {
+	defaultQ().Add(ctx, f)
+}
+
+// Wait blocks until the default Queue is idle: until every function
+// submitted by Go has finished.
+func Wait() {
+	<-defaultQ().Idle()
+}
@@ -0,0 +1,33 @@
+package goqueue
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDefaultQueue(t *testing.T) {
+	resetDefault()
+	t.Cleanup(resetDefault)
+	if err := SetDefaultMaxActive(0); err == nil {
+		t.Errorf("SetDefaultMaxActive(0) succeeded")
+	}
+	if err := SetDefaultMaxActive(2); err != nil {
+		t.Fatalf("SetDefaultMaxActive before first use returned %v", err)
+	}
+
+	var ran atomic.Int32
+	for i := 0; i < 10; i++ {
+		Go(context.Background(), func(context.Context) { ran.Add(1) })
+	}
+	Wait()
+	if n := ran.Load(); n != 10 {
+		t.Errorf("%d functions ran before Wait returned, want 10", n)
+	}
+	if n := defaultQ().MaxActive(); n != 2 {
+		t.Errorf("default queue limit = %d, want 2", n)
+	}
+	if err := SetDefaultMaxActive(3); err == nil {
+		t.Errorf("SetDefaultMaxActive after first use succeeded")
+	}
+}
@@ -0,0 +1,125 @@
+package goqueue
+
+import (
+	"container/list"
+	"context"
+)
+
+// Group runs functions from several named sub-queues under one shared
+// concurrency limit.
+//
+// Functions submitted under the same name start in FIFO order. When a slot
+// becomes available, the sub-queues take turns in round-robin order, so a
+// busy name cannot starve the others. Group is safe for concurrent use by
+// multiple goroutines.
+type Group struct {
+	q  *Queue
+	st chan groupState
+}
+
+type groupState struct {
+	backlogs map[string]*list.List // of groupItem, by name
+	names    []string              // names with a non-empty backlog, in turn order
+	turn     int                   // index in names of the next name to run
+}
+
+type groupItem struct {
+	ctx context.Context
+	f   func(context.Context)
+}
+
+// NewGroup creates a new Group that allows at most maxActive functions,
+// across all names, to run concurrently.
+//
+// maxActive must be greater than zero. If maxActive is less than 1,
+// NewGroup returns an error.
+func NewGroup(maxActive int) (*Group, error) {
+	q, err := NewQueue(maxActive)
+	if err != nil {
+		return nil, err
+	}
+	g := &Group{q: q, st: make(chan groupState, 1)}
+	g.st <- groupState{backlogs: make(map[string]*list.List)}
+	return g, nil
+}
+
+// Add submits a function to the sub-queue for name.
+//
+// The provided context is passed to f when it executes. If ctx is done
+// before f starts, f is discarded without running.
+func (g *Group) Add(name string, ctx context.Context, f func(context.Context)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	st := <-g.st
+	b := st.backlogs[name]
+	if b == nil {
+		b = list.New()
+		st.backlogs[name] = b
+	}
+	if b.Len() == 0 {
+		st.names = append(st.names, name)
+	}
+	b.PushBack(groupItem{ctx: ctx, f: f})
+	g.st <- st
+
+	// Each submission adds one runner to the underlying Queue. Whichever
+	// runner gets a slot runs the item whose turn it is, so the order in
+	// which runners start does not matter.
+	g.q.Add(context.Background(), g.runNext)
+}
+
+// runNext runs the next item in round-robin order, skipping items whose
+// context is done.
+func (g *Group) runNext(context.Context) {
+	for {
+		st := <-g.st
+		item, ok := st.pop()
+		g.st <- st
+		if !ok {
+			return
+		}
+		if item.ctx.Err() == nil {
+			item.f(item.ctx)
+			return
+		}
+	}
+}
+
+// pop removes and returns the front item of the sub-queue whose turn it
+// is, and advances the turn. It reports false if every sub-queue is empty.
+func (st *groupState) pop() (groupItem, bool) {
+	if len(st.names) == 0 {
+		return groupItem{}, false
+	}
+	if st.turn >= len(st.names) {
+		st.turn = 0
+	}
+	name := st.names[st.turn]
+	b := st.backlogs[name]
+	item := b.Remove(b.Front()).(groupItem)
+	if b.Len() == 0 {
+		delete(st.backlogs, name)
+		st.names = append(st.names[:st.turn], st.names[st.turn+1:]...)
+	} else {
+		st.turn++
+	}
+	return item, true
+}
+
+// BacklogLen returns the number of functions submitted under name that
+// are waiting to start.
+func (g *Group) BacklogLen(name string) int64 {
+	st := <-g.st
+	defer func() { g.st <- st }()
+	if b := st.backlogs[name]; b != nil {
+		return int64(b.Len())
+	}
+	return 0
+}
+
+// Idle returns a channel that is closed when the Group becomes idle, with
+// the same semantics as Queue.Idle.
+func (g *Group) Idle() <-chan struct{} {
+	return g.q.Idle()
+}
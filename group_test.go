@@ -0,0 +1,38 @@
+package goqueue
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestGroupRoundRobin(t *testing.T) {
+	g, _ := NewGroup(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	g.Add("block", ctx, func(context.Context) { <-unblock })
+
+	var order []string
+	for _, name := range []string{"a", "a", "a", "b", "b", "c"} {
+		label := name
+		g.Add(name, ctx, func(context.Context) { order = append(order, label) })
+	}
+	if n := g.BacklogLen("a"); n != 3 {
+		t.Errorf("BacklogLen(a) = %d, want 3", n)
+	}
+	if n := g.BacklogLen("missing"); n != 0 {
+		t.Errorf("BacklogLen(missing) = %d, want 0", n)
+	}
+
+	close(unblock)
+	<-g.Idle()
+	if got, want := strings.Join(order, ""), "abcaba"; got != want {
+		t.Errorf("execution order = %q, want %q", got, want)
+	}
+}
+
+func TestNewGroup(t *testing.T) {
+	if _, err := NewGroup(0); err == nil {
+		t.Errorf("expected error for non-positive limit")
+	}
+}
@@ -0,0 +1,80 @@
+package goqueue
+
+import "context"
+
+// AddKeyed is like Add, but f never runs concurrently with another
+// function submitted by AddKeyed with the same key. Functions for a key
+// whose previous function has not yet finished wait, in submission order,
+// until it has; they are submitted to the Queue one at a time and are not
+// counted by BacklogLen until then. Functions for different keys run
+// concurrently up to the Queue's limit.
+//
+// A waiting function is discarded by Cancel and Shutdown like any
+// backlogged function.
+func (q *Queue) AddKeyed(ctx context.Context, key string, f func(context.Context)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	t := &task{
+		ctx: ctx,
+		f: func(ctx context.Context) {
+			defer q.releaseKey(key)
+			f(ctx)
+		},
+		// dropped may be called with the state held, so the key is
+		// released asynchronously.
+		x: &taskExtra{dropped: func(error) { go q.releaseKey(key) }},
+	}
+
+	st := <-q.st
+	defer func() { q.unlock(st) }()
+	if waiting, busy := st.keyed[key]; busy {
+		if st.rejecting() != nil {
+			return
+		}
+		st.keyed[key] = append(waiting, t)
+		st.parked++
+		return
+	}
+	if st.keyed == nil {
+		st.keyed = make(map[string][]*task)
+	}
+	st.keyed[key] = nil
+	if _, err := q.submit(&st, t); err != nil {
+		delete(st.keyed, key)
+	}
+}
+
+// releaseKey records that the running function for key has finished or
+// been discarded, and submits the next function waiting for key, if any.
+func (q *Queue) releaseKey(key string) {
+	st := <-q.st
+	defer func() { q.unlock(st) }()
+	for {
+		waiting := st.keyed[key]
+		if len(waiting) == 0 {
+			delete(st.keyed, key)
+			st.signalIdle()
+			return
+		}
+		t := waiting[0]
+		waiting[0] = nil
+		st.keyed[key] = waiting[1:]
+		st.parked--
+		if _, err := q.accept(&st, t); err == nil {
+			st.signalIdle()
+			return
+		}
+		// t was discarded; try the next one.
+	}
+}
+
+// dropParked discards every function waiting for its key. The keys stay
+// busy until their running functions finish. The caller must hold st.
+func (st *queueState) dropParked() {
+	for key, waiting := range st.keyed {
+		clear(waiting)
+		st.keyed[key] = waiting[:0]
+	}
+	st.parked = 0
+}
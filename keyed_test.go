@@ -0,0 +1,77 @@
+package goqueue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueAddKeyed(t *testing.T) {
+	q, _ := NewQueue(4)
+	ctx := context.Background()
+	var (
+		mu      sync.Mutex
+		running = make(map[string]int)
+		order   = make(map[string][]int)
+		maxAll  int
+		all     int
+	)
+	for i := 0; i < 20; i++ {
+		key := []string{"a", "b"}[i%2]
+		q.AddKeyed(ctx, key, func(context.Context) {
+			mu.Lock()
+			running[key]++
+			all++
+			if running[key] > 1 {
+				t.Errorf("%d functions for key %s ran concurrently", running[key], key)
+			}
+			if all > maxAll {
+				maxAll = all
+			}
+			order[key] = append(order[key], i)
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			running[key]--
+			all--
+			mu.Unlock()
+		})
+	}
+	<-q.Idle()
+
+	if maxAll != 2 {
+		t.Errorf("at most %d functions ran concurrently, want 2", maxAll)
+	}
+	for key, seq := range order {
+		if len(seq) != 10 {
+			t.Errorf("%d functions ran for key %s, want 10", len(seq), key)
+		}
+		for j := 1; j < len(seq); j++ {
+			if seq[j] < seq[j-1] {
+				t.Errorf("functions for key %s ran out of order: %v", key, seq)
+				break
+			}
+		}
+	}
+}
+
+func TestQueueAddKeyedCancel(t *testing.T) {
+	q, _ := NewQueue(2)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.AddKeyed(ctx, "a", func(context.Context) { <-unblock })
+	q.AddKeyed(ctx, "a", func(context.Context) { t.Errorf("canceled function ran") })
+	if q.IsIdle() {
+		t.Errorf("queue with a function waiting for its key is idle")
+	}
+	q.Cancel()
+	close(unblock)
+	<-q.Idle()
+
+	// The key is free again.
+	ran := make(chan struct{})
+	q.AddKeyed(ctx, "a", func(context.Context) { close(ran) })
+	<-ran
+	<-q.Idle()
+}
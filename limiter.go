@@ -0,0 +1,82 @@
+package goqueue
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// A Limiter is a concurrency budget shared by several Queues, such as the
+// number of database connections available to all of them. Pass it to
+// each Queue with WithSharedLimiter: a function then starts only once its
+// own Queue's limit and the Limiter both have room for it, and holds its
+// share of the Limiter, its weight, until it returns. A function may
+// always start while the Limiter is otherwise unused, even if its weight
+// exceeds the Limiter's size.
+//
+// Backlogged functions held back by the Limiter start in the order their
+// Queues are woken when it frees up, so the Limiter does not make any
+// fairness guarantee between Queues.
+type Limiter struct {
+	mu   sync.Mutex
+	size int
+	used int
+	// waiting holds the Queues that have been refused since the last
+	// release, and so must be woken by the next one.
+	waiting []*Queue
+}
+
+// NewLimiter returns a Limiter that allows at most n functions to run at
+// once across the Queues sharing it. If n is less than 1, NewLimiter
+// returns an error.
+func NewLimiter(n int) (*Limiter, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("goQueue called with nonpositive shared limit (%d)", n)
+	}
+	return &Limiter{size: n}, nil
+}
+
+// acquire takes n units of l for a function of q, and reports whether it
+// could. If not, q is woken by the next release. The caller must hold q's
+// state, and l never acquires it.
+func (l *Limiter) acquire(q *Queue, n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.used > 0 && l.used+n > l.size {
+		if !slices.Contains(l.waiting, q) {
+			l.waiting = append(l.waiting, q)
+		}
+		return false
+	}
+	l.used += n
+	return true
+}
+
+// fits reports whether acquire would take n units of l now.
+func (l *Limiter) fits(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.used == 0 || l.used+n <= l.size
+}
+
+// release returns n units to l, and returns the Queues to wake, which the
+// caller must do once it has released its own Queue's state.
+func (l *Limiter) release(n int) []*Queue {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.used -= n
+	if l.used < 0 {
+		panic(fmt.Sprintf("goqueue: shared limiter count underflow (%d)", l.used))
+	}
+	waiting := l.waiting
+	l.waiting = nil
+	return waiting
+}
+
+// kick starts the backlogged functions of q that now fit, after a shared
+// Limiter has freed up. The caller must not hold any Queue's state.
+func (q *Queue) kick() {
+	st := <-q.st
+	q.fill(&st)
+	q.st <- st
+}
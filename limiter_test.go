@@ -0,0 +1,101 @@
+package goqueue
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewLimiter(t *testing.T) {
+	if _, err := NewLimiter(0); err == nil {
+		t.Errorf("expected error for non-positive shared limit")
+	}
+}
+
+func TestWithSharedLimiter(t *testing.T) {
+	l, _ := NewLimiter(3)
+	ctx := context.Background()
+	var running, peak atomic.Int32
+	work := func(context.Context) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		running.Add(-1)
+	}
+
+	var queues []*Queue
+	for range 3 {
+		q, _ := NewQueueWithOptions(2, WithSharedLimiter(l))
+		queues = append(queues, q)
+	}
+	var wg sync.WaitGroup
+	for _, q := range queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 20 {
+				q.Add(ctx, work)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, q := range queues {
+		<-q.Idle()
+		if n := q.Completed(); n != 20 {
+			t.Errorf("queue completed %d functions, want 20", n)
+		}
+	}
+	if p := peak.Load(); p > 3 {
+		t.Errorf("%d functions ran at once across the queues, want at most 3", p)
+	}
+}
+
+func TestSharedLimiterWakesOtherQueues(t *testing.T) {
+	l, _ := NewLimiter(1)
+	a, _ := NewQueueWithOptions(1, WithSharedLimiter(l))
+	b, _ := NewQueueWithOptions(1, WithSharedLimiter(l))
+	ctx := context.Background()
+
+	unblock := make(chan struct{})
+	a.Add(ctx, func(context.Context) { <-unblock })
+	started := make(chan struct{})
+	if s := b.Submit(ctx, func(context.Context) { close(started) }); s.Started {
+		t.Fatalf("function started while the shared limiter was in use")
+	}
+	if n := b.BacklogLen(); n != 1 {
+		t.Errorf("BacklogLen = %d, want 1", n)
+	}
+	close(unblock)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("function held back by the shared limiter did not start once it was released")
+	}
+	<-a.Idle()
+	<-b.Idle()
+}
+
+func TestSharedLimiterWouldDeadlock(t *testing.T) {
+	l, _ := NewLimiter(1)
+	q, _ := NewQueueWithOptions(2, WithSharedLimiter(l))
+	errc := make(chan error, 1)
+	q.Add(context.Background(), func(ctx context.Context) {
+		errc <- q.AddWait(ctx, func(context.Context) {})
+	})
+	select {
+	case err := <-errc:
+		if err != ErrWouldDeadlock {
+			t.Errorf("AddWait with the shared limiter in use by its caller returned %v, want %v", err, ErrWouldDeadlock)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("AddWait deadlocked waiting for the shared limiter")
+	}
+	<-q.Idle()
+}
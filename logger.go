@@ -0,0 +1,17 @@
+package goqueue
+
+// A Logger receives human-readable messages about a Queue's activity, for
+// debugging: when functions start, complete or panic, and when they are
+// backlogged. Adapt a logging package to it and install it with
+// WithLogger. Debugf is used for routine events and Warnf for panics. The
+// arguments are as for fmt.Printf.
+//
+// The Queue never calls a Logger while holding its internal lock. Events
+// that arise under the lock, such as a function being backlogged, are
+// logged once it has been released, so messages from different functions
+// may arrive out of order. A Logger may be called concurrently from
+// multiple goroutines.
+type Logger interface {
+	Debugf(format string, args ...any)
+	Warnf(format string, args ...any)
+}
@@ -0,0 +1,122 @@
+package goqueue
+
+import (
+	"math"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// A Collector receives metrics about a Queue's activity, so that they can
+// be exported to a monitoring system without this package depending on
+// it. Install one with WithCollector.
+//
+// The Queue may call a Collector's methods while holding its internal
+// lock, so they must be fast and must not call back into the Queue. They
+// may be called concurrently from multiple goroutines.
+type Collector interface {
+	// IncSubmitted is called each time a function is accepted.
+	IncSubmitted()
+	// IncCompleted is called each time a function finishes running,
+	// including functions that panicked.
+	IncCompleted()
+	// ObserveWait is called when a function starts, with the time it
+	// spent in the backlog. Functions started immediately report zero.
+	ObserveWait(d time.Duration)
+	// ObserveRun is called when a function finishes, with its running
+	// time.
+	ObserveRun(d time.Duration)
+	// SetBacklog is called with the new backlog length each time it
+	// changes.
+	SetBacklog(n int)
+}
+
+// durationHistogram counts durations in fixed buckets without locking.
+type durationHistogram struct {
+	bounds []time.Duration // ascending upper bounds, inclusive
+	counts []atomic.Uint64 // one per bound, then one for longer durations
+}
+
+// newDurationHistogram returns a histogram with the given bucket bounds,
+// which need not be sorted or distinct, or nil if there are none.
+func newDurationHistogram(bounds []time.Duration) *durationHistogram {
+	if len(bounds) == 0 {
+		return nil
+	}
+	bounds = slices.Clone(bounds)
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+	return &durationHistogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+// observe counts d in the first bucket whose bound is at least d.
+func (h *durationHistogram) observe(d time.Duration) {
+	i, _ := slices.BinarySearch(h.bounds, d)
+	h.counts[i].Add(1)
+}
+
+// reset sets every bucket's count back to zero.
+func (h *durationHistogram) reset() {
+	for i := range h.counts {
+		h.counts[i].Store(0)
+	}
+}
+
+// snapshot returns the count of each bucket keyed by its bound, with
+// durations above every bound keyed by math.MaxInt64.
+func (h *durationHistogram) snapshot() map[time.Duration]uint64 {
+	m := make(map[time.Duration]uint64, len(h.counts))
+	for i, b := range h.bounds {
+		m[b] = h.counts[i].Load()
+	}
+	m[math.MaxInt64] = h.counts[len(h.bounds)].Load()
+	return m
+}
+
+// throughputBuckets is the number of one-second buckets kept by a
+// throughputRing, and so the longest window RecentThroughput can cover.
+const throughputBuckets = 60
+
+// throughputRing counts completions per second over the last
+// throughputBuckets seconds, in constant space. Each bucket records the
+// second it counts, so buckets left over from earlier laps of the ring are
+// recognised as stale rather than cleared on a timer.
+type throughputRing struct {
+	secs   [throughputBuckets]int64
+	counts [throughputBuckets]int64
+}
+
+// add counts one completion at now.
+func (r *throughputRing) add(now time.Time) {
+	s := now.Unix()
+	i := bucketIndex(s)
+	if r.secs[i] != s {
+		r.secs[i], r.counts[i] = s, 0
+	}
+	r.counts[i]++
+}
+
+// rate returns the completions per second over the window ending at now,
+// which must be positive and at most throughputBuckets seconds.
+func (r *throughputRing) rate(now time.Time, window time.Duration) float64 {
+	n := int64((window + time.Second - 1) / time.Second)
+	s := now.Unix()
+	var sum int64
+	for k := range n {
+		if i := bucketIndex(s - k); r.secs[i] == s-k {
+			sum += r.counts[i]
+		}
+	}
+	return float64(sum) / window.Seconds()
+}
+
+func bucketIndex(s int64) int {
+	i := s % throughputBuckets
+	if i < 0 {
+		i += throughputBuckets
+	}
+	return int(i)
+}
@@ -0,0 +1,154 @@
+package goqueue
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testCollector struct {
+	mu         sync.Mutex
+	submitted  int
+	completed  int
+	waits      []time.Duration
+	runs       []time.Duration
+	maxBacklog int
+}
+
+func (c *testCollector) IncSubmitted() {
+	c.mu.Lock()
+	c.submitted++
+	c.mu.Unlock()
+}
+
+func (c *testCollector) IncCompleted() {
+	c.mu.Lock()
+	c.completed++
+	c.mu.Unlock()
+}
+
+func (c *testCollector) ObserveWait(d time.Duration) {
+	c.mu.Lock()
+	c.waits = append(c.waits, d)
+	c.mu.Unlock()
+}
+
+func (c *testCollector) ObserveRun(d time.Duration) {
+	c.mu.Lock()
+	c.runs = append(c.runs, d)
+	c.mu.Unlock()
+}
+
+func (c *testCollector) SetBacklog(n int) {
+	c.mu.Lock()
+	if n > c.maxBacklog {
+		c.maxBacklog = n
+	}
+	c.mu.Unlock()
+}
+
+func TestQueueCollector(t *testing.T) {
+	c := new(testCollector)
+	q, _ := NewQueueWithOptions(1, WithCollector(c))
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		q.Add(ctx, func(context.Context) { time.Sleep(5 * time.Millisecond) })
+	}
+	<-q.Idle()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.submitted != 3 || c.completed != 3 {
+		t.Errorf("submitted, completed = %d, %d; want 3, 3", c.submitted, c.completed)
+	}
+	if c.maxBacklog != 2 {
+		t.Errorf("max backlog = %d, want 2", c.maxBacklog)
+	}
+	if len(c.waits) != 3 || c.waits[2] < 10*time.Millisecond {
+		t.Errorf("waits = %v, want 3 with the last at least 10ms", c.waits)
+	}
+	for _, d := range c.runs {
+		if d < 5*time.Millisecond {
+			t.Errorf("observed run time %v, want at least 5ms", d)
+		}
+	}
+}
+
+func TestQueueRunDurationHistogram(t *testing.T) {
+	plain, _ := NewQueue(1)
+	if h := plain.RunDurationHistogram(); h != nil {
+		t.Errorf("RunDurationHistogram without buckets = %v, want nil", h)
+	}
+
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	q, _ := NewQueueWithOptions(1, WithClock(clock),
+		WithRunDurationBuckets(100*time.Millisecond, 10*time.Millisecond, time.Second))
+	ctx := context.Background()
+	for _, d := range []time.Duration{time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond, time.Second, time.Minute} {
+		q.Add(ctx, func(context.Context) { clock.advance(d) })
+	}
+	<-q.Idle()
+
+	want := map[time.Duration]uint64{
+		10 * time.Millisecond:  2,
+		100 * time.Millisecond: 1,
+		time.Second:            1,
+		math.MaxInt64:          1,
+	}
+	got := q.RunDurationHistogram()
+	if len(got) != len(want) {
+		t.Errorf("RunDurationHistogram = %v, want %v", got, want)
+	}
+	for b, n := range want {
+		if got[b] != n {
+			t.Errorf("bucket %v counted %d, want %d", b, got[b], n)
+		}
+	}
+
+	if err := q.Reset(); err != nil {
+		t.Fatalf("Reset returned %v", err)
+	}
+	for b, n := range q.RunDurationHistogram() {
+		if n != 0 {
+			t.Errorf("bucket %v counted %d after Reset, want 0", b, n)
+		}
+	}
+}
+
+func TestQueueRecentThroughput(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	q, _ := NewQueueWithOptions(1, WithClock(clock))
+	ctx := context.Background()
+	complete := func(n int) {
+		for range n {
+			q.Add(ctx, func(context.Context) {})
+		}
+		<-q.Idle()
+	}
+
+	complete(30)
+	clock.advance(10 * time.Second)
+	complete(10)
+	if got := q.RecentThroughput(5 * time.Second); got != 2 {
+		t.Errorf("RecentThroughput(5s) = %v, want 2", got)
+	}
+	if got := q.RecentThroughput(20 * time.Second); got != 2 {
+		t.Errorf("RecentThroughput(20s) = %v, want 2", got)
+	}
+	if got := q.RecentThroughput(0); got != 0 {
+		t.Errorf("RecentThroughput(0) = %v, want 0", got)
+	}
+
+	// Buckets from more than a minute ago are not counted, even once the
+	// ring has wrapped round to reuse them.
+	clock.advance(55 * time.Second)
+	if got := q.RecentThroughput(time.Hour); got != 10.0/60 {
+		t.Errorf("RecentThroughput(1h) = %v, want %v", got, 10.0/60)
+	}
+	clock.advance(10 * time.Second)
+	if got := q.RecentThroughput(time.Minute); got != 0 {
+		t.Errorf("RecentThroughput after a minute idle = %v, want 0", got)
+	}
+}
@@ -0,0 +1,247 @@
+package goqueue
+
+import (
+	"context"
+	"time"
+)
+
+// An Option configures a Queue created by NewQueueWithOptions.
+type Option func(*options)
+
+// options holds the configuration collected from a list of Options.
+type options struct {
+	maxBacklog     int
+	maxSubmissions int64
+	hooks          hooks
+	errorHandler   ErrorHandler
+	rateN          int
+	ratePer        time.Duration
+	ordering       Ordering
+	workerPool     bool
+	threshold      int
+	onExceed       func(len int64)
+	ceiling        int
+	clock          Clock
+	aging          time.Duration
+	jitter         time.Duration
+	hard           int
+	scheduler      Scheduler
+	shared         *Limiter
+}
+
+// WithClock sets the Clock the Queue uses for delays, timeouts, rate
+// limiting and timings. It is intended for tests; the default is the real
+// clock.
+func WithClock(c Clock) Option {
+	return func(o *options) { o.clock = c }
+}
+
+// WithMaxBacklog limits the number of functions that may wait in the
+// backlog, with the same meaning as the maxBacklog argument of
+// NewBoundedQueue. The default is an unbounded backlog.
+func WithMaxBacklog(n int) Option {
+	return func(o *options) { o.maxBacklog = n }
+}
+
+// WithPanicHandler sets the Queue's PanicHandler, as by SetPanicHandler.
+func WithPanicHandler(h PanicHandler) Option {
+	return func(o *options) { o.hooks.panicHandler = h }
+}
+
+// WithErrorHandler sets the Queue's ErrorHandler, as by SetErrorHandler.
+func WithErrorHandler(h ErrorHandler) Option {
+	return func(o *options) { o.errorHandler = h }
+}
+
+// WithOnStart sets the Queue's start hook, as by SetOnStart.
+func WithOnStart(h func(ctx context.Context)) Option {
+	return func(o *options) { o.hooks.onStart = h }
+}
+
+// WithOnComplete sets the Queue's completion hook, as by SetOnComplete.
+func WithOnComplete(h func(ctx context.Context, elapsed time.Duration)) Option {
+	return func(o *options) { o.hooks.onComplete = h }
+}
+
+// WithOnTaskContextDone sets a hook that is called each time the Queue
+// cancels a context it derived for running functions, which it does once
+// the last running function submitted with the same context has returned.
+// h is passed the cancelled context, as seen by that last function, and
+// may release resources tied to it.
+//
+// h is called on the goroutine that ran the function, without the Queue's
+// internal lock held, after the function's slot has been released; the
+// Queue may already be idle when h is called.
+func WithOnTaskContextDone(h func(ctx context.Context)) Option {
+	return func(o *options) { o.hooks.contextDone = h }
+}
+
+// WithRateLimit limits the Queue to starting at most n functions in any
+// period of length per, in addition to the concurrency limit. Up to n
+// functions may start in a burst; after that, starts are spaced evenly.
+//
+// A function that has been given a slot but not yet a start token waits
+// in its slot, so the number of functions waiting or running never
+// exceeds the concurrency limit. If its context is done while it waits,
+// the function is discarded without running.
+//
+// n must be at least 1 and per must be positive, or NewQueueWithOptions
+// returns an error.
+func WithRateLimit(n int, per time.Duration) Option {
+	return func(o *options) {
+		o.rateN = n
+		o.ratePer = per
+	}
+}
+
+// WithStartJitter delays the start of each function by a random duration
+// of less than max, to spread out bursts of starts such as those that
+// follow Resume or a raised limit. A function waits out its delay in the
+// slot it has been given, as it does for WithRateLimit, so the jitter
+// changes only when functions start, never how many run at once. If its
+// context is done while it waits, the function is discarded without
+// running.
+//
+// By default, and if max is not positive, functions start without delay.
+func WithStartJitter(max time.Duration) Option {
+	return func(o *options) { o.jitter = max }
+}
+
+// WithRunDurationBuckets makes the Queue count the running time of each
+// function in a histogram with the given bucket bounds, for
+// RunDurationHistogram. A function is counted in the bucket of the
+// smallest bound at least as long as its running time, or in an overflow
+// bucket if it ran longer than every bound. By default no histogram is
+// kept, at no cost.
+func WithRunDurationBuckets(bounds ...time.Duration) Option {
+	return func(o *options) { o.hooks.runs = newDurationHistogram(bounds) }
+}
+
+// WithCollector installs c to receive the Queue's metrics. By default no
+// metrics are collected, at no cost.
+func WithCollector(c Collector) Option {
+	return func(o *options) { o.hooks.collector = c }
+}
+
+// WithSharedLimiter makes the Queue's functions also count against l,
+// which may be shared with other Queues, so that each starts only once
+// both the Queue and l have room for it. See Limiter.
+func WithSharedLimiter(l *Limiter) Option {
+	return func(o *options) { o.shared = l }
+}
+
+// WithContextEnricher makes the Queue call enrich before each function
+// runs, and run the function, and the WithOnStart and WithOnComplete hooks,
+// with a context carrying the values of the one enrich returns, which
+// should be derived from the one it is given. attempt is 1 except for the
+// retries of a function submitted by AddRetry, which are numbered from 2,
+// so that tracing can record which attempt a run is. enrich is called in
+// the function's slot, without the Queue's lock held.
+func WithContextEnricher(enrich func(ctx context.Context, attempt int) context.Context) Option {
+	return func(o *options) { o.hooks.enrich = enrich }
+}
+
+// WithLogger installs l to log the Queue's activity. By default nothing is
+// logged, at no cost.
+func WithLogger(l Logger) Option {
+	return func(o *options) { o.hooks.logger = l }
+}
+
+// WithOrdering sets the order in which backlogged functions of equal
+// priority are started. The default is FIFO.
+func WithOrdering(ord Ordering) Option {
+	return func(o *options) { o.ordering = ord }
+}
+
+// WithScheduler makes s decide the order in which backlogged functions
+// start, in place of the built-in ordering by priority, WithOrdering and
+// WithAging. The package provides NewFIFOScheduler and NewLIFOScheduler;
+// others, such as earliest deadline first, can be built on the fields of
+// Pending. The Queue still enforces its limits, Barriers and AddKeyed
+// ordering: it hands s only functions that are ready to start, and
+// starts each function s pops as soon as it fits.
+//
+// A function removed from the backlog, as by Cancel or Handle.Cancel,
+// remains in s until s pops it, and is then skipped. Methods that list
+// the backlog, such as PendingPayloads and PeekLabels, list it in
+// submission order.
+//
+// s must not be shared between Queues.
+func WithScheduler(s Scheduler) Option {
+	return func(o *options) { o.scheduler = s }
+}
+
+// WithAging keeps low-priority functions from starving behind a steady
+// stream of higher-priority ones. The oldest backlogged function of each
+// priority is treated as one level higher for every rate it has waited,
+// and starts ahead of a function of a higher priority once its promoted
+// level is above that function's own. Ties go to the higher priority.
+//
+// By default, and if rate is not positive, functions are not aged and
+// priorities are strict.
+func WithAging(rate time.Duration) Option {
+	return func(o *options) { o.aging = rate }
+}
+
+// WithMaxSubmissions limits the total number of functions the Queue will
+// ever accept to n. Once n functions have been accepted, by any method,
+// further submissions are rejected with ErrQuotaExceeded. Submissions
+// rejected for any reason do not count toward the quota. A negative n
+// means no limit, which is the default.
+func WithMaxSubmissions(n int64) Option {
+	return func(o *options) { o.maxSubmissions = n }
+}
+
+// WithDroppedHandler sets a function called, in its own goroutine, for
+// each backlogged function that is discarded when it reaches the front of
+// the backlog because its context is done or its deadline has passed.
+// Such functions are always skipped; the handler only observes them.
+func WithDroppedHandler(h DroppedHandler) Option {
+	return func(o *options) { o.hooks.dropped = h }
+}
+
+// WithWorkerPool, if enabled, makes the Queue start maxActive long-lived
+// worker goroutines up front and hand functions to them, rather than
+// starting a goroutine whenever a function gets a free slot. If every
+// pooled worker is busy, as after SetMaxActive raises the limit, a
+// goroutine is started as usual. The pooled workers exit once the Queue
+// has been shut down, by Shutdown, ShutdownForce, ShutdownNow or the
+// cancellation of the context given to NewQueueWithContext, and once it
+// becomes idle after Close or Drain; Reset starts them again.
+func WithWorkerPool(enabled bool) Option {
+	return func(o *options) { o.workerPool = enabled }
+}
+
+// WithBacklogThreshold sets a function called with the backlog length
+// whenever the backlog grows past n functions. It is called once each
+// time the length crosses n, not for every function backlogged while it
+// remains above n. onExceed is called in its own goroutine, so it may
+// block or use the Queue.
+func WithBacklogThreshold(n int, onExceed func(len int64)) Option {
+	return func(o *options) {
+		o.threshold = n
+		o.onExceed = onExceed
+	}
+}
+
+// WithHardLimit lets functions submitted with PriorityHigh start even
+// when maxActive functions are running, as long as fewer than hard are.
+// Other functions still start only while fewer than maxActive functions of
+// any priority are running, so the extra slots serve urgent work alone.
+// With WithHardLimit, the Queue may therefore run up to hard functions at
+// once.
+//
+// hard must be at least maxActive; otherwise NewQueueWithOptions returns
+// an error. The hard limit is fixed: if SetMaxActive later raises the
+// limit to hard or above, high-priority functions get no extra slots.
+func WithHardLimit(hard int) Option {
+	return func(o *options) { o.hard = hard }
+}
+
+// WithMaxActiveCeiling guards against configuration mistakes by capping
+// the concurrency limit at n: NewQueueWithOptions returns an error if
+// maxActive is greater than n, as does SetMaxActive for a larger limit.
+// A value of 0 or less sets no ceiling, which is the default.
+func WithMaxActiveCeiling(n int) Option {
+	return func(o *options) { o.ceiling = n }
+}
@@ -0,0 +1,675 @@
+package goqueue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewQueueWithOptions(t *testing.T) {
+	if _, err := NewQueueWithOptions(0); err == nil {
+		t.Errorf("expected error for non-positive queue length")
+	}
+
+	errc := make(chan error, 1)
+	panics := make(chan any, 1)
+	q, err := NewQueueWithOptions(1,
+		WithMaxBacklog(0),
+		WithErrorHandler(func(err error) { errc <- err }),
+		WithPanicHandler(func(r any, _ []byte) { panics <- r }),
+	)
+	if err != nil {
+		t.Fatalf("NewQueueWithOptions returned %v", err)
+	}
+
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != ErrBacklogFull {
+		t.Errorf("Enqueue with WithMaxBacklog(0) returned %v, want %v", err, ErrBacklogFull)
+	}
+	close(unblock)
+	<-q.Idle()
+
+	errBoom := errors.New("boom")
+	q.AddErr(ctx, func(context.Context) error { return errBoom })
+	if err := <-errc; err != errBoom {
+		t.Errorf("ErrorHandler received %v, want %v", err, errBoom)
+	}
+	<-q.Idle()
+
+	q.Add(ctx, func(context.Context) { panic("boom") })
+	if r := <-panics; r != "boom" {
+		t.Errorf("PanicHandler recovered %v, want %q", r, "boom")
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	if _, err := NewQueueWithOptions(1, WithRateLimit(0, time.Second)); err == nil {
+		t.Errorf("expected error for non-positive rate")
+	}
+
+	const (
+		n   = 2
+		per = 50 * time.Millisecond
+	)
+	q, _ := NewQueueWithOptions(4, WithRateLimit(n, per))
+	ctx := context.Background()
+	var (
+		mu     sync.Mutex
+		starts []time.Time
+	)
+	begin := time.Now()
+	for i := 0; i < 6; i++ {
+		q.Add(ctx, func(context.Context) {
+			mu.Lock()
+			starts = append(starts, time.Now())
+			mu.Unlock()
+		})
+	}
+	<-q.Idle()
+
+	// The first n start in a burst; the remaining four are spaced per/n
+	// apart, so the last cannot start before 4*per/n has elapsed.
+	mu.Lock()
+	defer mu.Unlock()
+	if len(starts) != 6 {
+		t.Fatalf("%d functions started, want 6", len(starts))
+	}
+	last := starts[0]
+	for _, s := range starts {
+		if s.After(last) {
+			last = s
+		}
+	}
+	if min := 4 * per / n; last.Sub(begin) < min {
+		t.Errorf("last start after %v, want at least %v", last.Sub(begin), min)
+	}
+}
+
+func TestWithOrdering(t *testing.T) {
+	for _, tc := range []struct {
+		ord  Ordering
+		want []int
+	}{
+		{FIFO, []int{1, 2, 3}},
+		{LIFO, []int{3, 2, 1}},
+	} {
+		q, _ := NewQueueWithOptions(1, WithOrdering(tc.ord))
+		ctx := context.Background()
+		unblock := make(chan struct{})
+		q.Add(ctx, func(context.Context) { <-unblock })
+
+		var got []int
+		for i := 1; i <= 3; i++ {
+			q.Add(ctx, func(context.Context) { got = append(got, i) })
+		}
+		close(unblock)
+		<-q.Idle()
+
+		for i := range tc.want {
+			if i >= len(got) || got[i] != tc.want[i] {
+				t.Errorf("ordering %d ran %v, want %v", tc.ord, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestWithMaxSubmissions(t *testing.T) {
+	q, _ := NewQueueWithOptions(1, WithMaxSubmissions(3), WithMaxBacklog(1))
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	if err := q.Enqueue(ctx, func(context.Context) { <-unblock }); err != nil {
+		t.Fatalf("first Enqueue returned %v", err)
+	}
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != nil {
+		t.Fatalf("second Enqueue returned %v", err)
+	}
+	// Rejected because the backlog is full; does not use up the quota.
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != ErrBacklogFull {
+		t.Errorf("Enqueue to full backlog returned %v, want %v", err, ErrBacklogFull)
+	}
+	close(unblock)
+	<-q.Idle()
+
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != nil {
+		t.Errorf("third accepted Enqueue returned %v", err)
+	}
+	<-q.Idle()
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != ErrQuotaExceeded {
+		t.Errorf("Enqueue beyond quota returned %v, want %v", err, ErrQuotaExceeded)
+	}
+	if n := q.Completed(); n != 3 {
+		t.Errorf("Completed = %d, want 3", n)
+	}
+}
+
+func TestWithDroppedHandler(t *testing.T) {
+	type key struct{}
+	dropped := make(chan context.Context, 2)
+	q, _ := NewQueueWithOptions(1, WithDroppedHandler(func(ctx context.Context) { dropped <- ctx }))
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+
+	canceled, cancel := context.WithCancel(context.WithValue(ctx, key{}, "canceled"))
+	cancel()
+	q.Add(canceled, func(context.Context) { t.Errorf("function with canceled context ran") })
+	past, cancelPast := context.WithDeadline(context.WithValue(ctx, key{}, "expired"), time.Now().Add(-time.Second))
+	defer cancelPast()
+	q.Add(past, func(context.Context) { t.Errorf("function with expired deadline ran") })
+	ran := make(chan struct{})
+	q.Add(ctx, func(context.Context) { close(ran) })
+
+	close(unblock)
+	<-ran
+	<-q.Idle()
+	for _, want := range []string{"canceled", "expired"} {
+		select {
+		case ctx := <-dropped:
+			if v := ctx.Value(key{}); v != "canceled" && v != "expired" {
+				t.Errorf("DroppedHandler called with unexpected context %v", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("DroppedHandler not called for the %s function", want)
+		}
+	}
+}
+
+func TestWithWorkerPool(t *testing.T) {
+	q, _ := NewQueueWithOptions(2, WithWorkerPool(true))
+	ctx := context.Background()
+	var (
+		mu      sync.Mutex
+		active  int
+		maxSeen int
+		ran     int
+	)
+	for i := 0; i < 50; i++ {
+		q.Add(ctx, func(context.Context) {
+			mu.Lock()
+			active++
+			ran++
+			if active > maxSeen {
+				maxSeen = active
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+		})
+	}
+	<-q.Idle()
+	if ran != 50 {
+		t.Errorf("%d functions ran, want 50", ran)
+	}
+	if maxSeen > 2 {
+		t.Errorf("%d functions ran concurrently, want at most 2", maxSeen)
+	}
+
+	// Raising the limit beyond the pool still runs functions concurrently.
+	q.SetMaxActive(4)
+	started := make(chan struct{}, 4)
+	unblock := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		q.Add(ctx, func(context.Context) {
+			started <- struct{}{}
+			<-unblock
+		})
+	}
+	for i := 0; i < 4; i++ {
+		<-started
+	}
+	close(unblock)
+
+	if err := q.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
+
+func TestWithWorkerPoolClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	q, _ := NewQueueWithOptions(8, WithWorkerPool(true))
+	ctx := context.Background()
+	q.Add(ctx, func(context.Context) { time.Sleep(time.Millisecond) })
+	q.Close()
+	if err := q.Drain(ctx); err != nil {
+		t.Fatalf("Drain returned %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines running after the queue was drained, want at most %d", n, before)
+	}
+
+	// Reset starts the pooled workers again.
+	if err := q.Reset(); err != nil {
+		t.Fatalf("Reset returned %v", err)
+	}
+	ran := make(chan struct{})
+	q.Add(ctx, func(context.Context) { close(ran) })
+	<-ran
+	if err := q.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown returned %v", err)
+	}
+}
+
+func TestWithBacklogThreshold(t *testing.T) {
+	exceeded := make(chan int64, 10)
+	q, _ := NewQueueWithOptions(1, WithBacklogThreshold(2, func(n int64) { exceeded <- n }))
+	ctx := context.Background()
+
+	for round := 0; round < 2; round++ {
+		unblock := make(chan struct{})
+		q.Add(ctx, func(context.Context) { <-unblock })
+		for i := 0; i < 5; i++ {
+			q.Add(ctx, func(context.Context) {})
+		}
+		close(unblock)
+		<-q.Idle()
+
+		select {
+		case n := <-exceeded:
+			if n != 3 {
+				t.Errorf("round %d: onExceed called with %d, want 3", round, n)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("round %d: onExceed not called", round)
+		}
+		select {
+		case n := <-exceeded:
+			t.Errorf("round %d: onExceed called again with %d", round, n)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestWithMaxActiveCeiling(t *testing.T) {
+	if _, err := NewQueueWithOptions(500000, WithMaxActiveCeiling(1000)); err == nil {
+		t.Errorf("expected error for limit above the ceiling")
+	}
+	q, err := NewQueueWithOptions(1000, WithMaxActiveCeiling(1000))
+	if err != nil {
+		t.Fatalf("NewQueueWithOptions at the ceiling returned %v", err)
+	}
+	if err := q.SetMaxActive(1001); err == nil {
+		t.Errorf("expected error from SetMaxActive above the ceiling")
+	}
+	if n := q.MaxActive(); n != 1000 {
+		t.Errorf("MaxActive = %d after rejected SetMaxActive, want 1000", n)
+	}
+}
+
+// fakeClock is a Clock whose time only moves when advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	c       chan time.Time
+	when    time.Time
+	stopped bool
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), when: c.now.Add(d)}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// advance moves the clock forward by d, firing any timers that fall due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case !t.when.After(c.now):
+			t.c <- c.now
+		default:
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+}
+
+// waiting returns the number of timers that have neither fired nor been
+// stopped.
+func (c *fakeClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, t := range c.timers {
+		if !t.stopped {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := !t.stopped && t.when.After(t.clock.now)
+	t.stopped = true
+	return active
+}
+
+func TestWithClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	q, err := NewQueueWithOptions(1, WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	ran := make(chan struct{})
+	q.AddAfter(ctx, time.Hour, func(context.Context) { close(ran) })
+	for clock.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.advance(59 * time.Minute)
+	select {
+	case <-ran:
+		t.Fatalf("function ran before its delay on the fake clock")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.advance(time.Minute)
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatalf("function did not run once the fake clock passed its delay")
+	}
+	<-q.Idle()
+
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) {
+		close(started)
+		<-unblock
+	})
+	<-started
+	clock.advance(5 * time.Second)
+	if age := q.OldestActiveAge(); age != 5*time.Second {
+		t.Errorf("OldestActiveAge = %v, want 5s", age)
+	}
+	close(unblock)
+	<-q.Idle()
+}
+
+func TestWithAging(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	q, _ := NewQueueWithOptions(1, WithAging(time.Minute), WithClock(clock))
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+
+	var got []string
+	add := func(p Priority, name string) {
+		q.AddPriority(ctx, p, func(context.Context) { got = append(got, name) })
+	}
+	add(PriorityLow, "low")
+	// Two minutes promote the low-priority function to PriorityHigh.
+	clock.advance(2 * time.Minute)
+	add(PriorityNormal, "normal")
+	add(PriorityHigh, "high")
+	close(unblock)
+	<-q.Idle()
+
+	if s := strings.Join(got, ","); s != "high,low,normal" {
+		t.Errorf("aged queue ran %s, want high,low,normal", s)
+	}
+}
+
+func TestWithStartJitter(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	q, _ := NewQueueWithOptions(2, WithStartJitter(time.Second), WithClock(clock))
+	ctx := context.Background()
+	q.Pause()
+	var running, peak atomic.Int64
+	ran := make(chan struct{}, 4)
+	for i := 0; i < 4; i++ {
+		q.Add(ctx, func(context.Context) {
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+			ran <- struct{}{}
+		})
+	}
+	q.Resume()
+
+	// Both slots are taken, but their functions wait out their jitter.
+	for clock.waiting() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-ran:
+		t.Fatalf("function started before its jitter elapsed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	deadline := time.After(time.Second)
+	for done := 0; done < 4; {
+		clock.advance(time.Second)
+		select {
+		case <-ran:
+			done++
+		case <-time.After(time.Millisecond):
+		case <-deadline:
+			t.Fatalf("only %d functions ran after their jitter elapsed", done)
+		}
+	}
+	<-q.Idle()
+	if p := peak.Load(); p > 2 {
+		t.Errorf("%d functions ran at once with a limit of 2", p)
+	}
+}
+
+func TestWithOnTaskContextDone(t *testing.T) {
+	released := make(chan context.Context, 2)
+	q, _ := NewQueueWithOptions(2, WithOnTaskContextDone(func(ctx context.Context) { released <- ctx }))
+	ctx := context.Background()
+
+	unblock := make(chan struct{})
+	seen := make(chan context.Context, 2)
+	for i := 0; i < 2; i++ {
+		q.Add(ctx, func(ctx context.Context) {
+			seen <- ctx
+			<-unblock
+		})
+	}
+	first, second := <-seen, <-seen
+	close(unblock)
+	<-q.Idle()
+
+	select {
+	case done := <-released:
+		if done.Err() != context.Canceled {
+			t.Errorf("hook called with context error %v, want Canceled", done.Err())
+		}
+		if done != first && done != second {
+			t.Errorf("hook called with a context no function ran with")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("hook not called")
+	}
+	// Both functions ran with one shared context, released once.
+	select {
+	case <-released:
+		t.Errorf("hook called twice for one shared context")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if first.Err() == nil || second.Err() == nil {
+		t.Errorf("function contexts not cancelled after the Queue became idle")
+	}
+}
+
+func TestWithHardLimit(t *testing.T) {
+	if _, err := NewQueueWithOptions(2, WithHardLimit(1)); err == nil {
+		t.Errorf("expected error for a hard limit below maxActive")
+	}
+	q, _ := NewQueueWithOptions(1, WithHardLimit(2))
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	normalRan := make(chan struct{})
+	q.Add(ctx, func(context.Context) { close(normalRan) })
+
+	urgent := make(chan struct{})
+	q.AddPriority(ctx, PriorityHigh, func(context.Context) {
+		close(urgent)
+		<-unblock
+	})
+	select {
+	case <-urgent:
+	case <-time.After(time.Second):
+		t.Fatalf("high-priority function did not start in an overflow slot")
+	}
+	if s := q.Submit(ctx, func(context.Context) {}); s.Started {
+		t.Errorf("normal function started above the soft limit")
+	}
+	if n := q.ActiveCount(); n != 2 {
+		t.Errorf("ActiveCount = %d, want 2", n)
+	}
+	q.AddPriority(ctx, PriorityHigh, func(context.Context) {})
+	if n := q.ActiveCount(); n != 2 {
+		t.Errorf("ActiveCount = %d above the hard limit", n)
+	}
+	select {
+	case <-normalRan:
+		t.Errorf("normal function ran above the soft limit")
+	default:
+	}
+	close(unblock)
+	<-q.Idle()
+}
+
+// recordingLogger is a Logger that records the messages it is given.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...any) { l.record("debug: "+format, args) }
+func (l *recordingLogger) Warnf(format string, args ...any)  { l.record("warn: "+format, args) }
+
+func (l *recordingLogger) record(format string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+func (l *recordingLogger) has(msg string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.messages {
+		if m == msg {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWithLogger(t *testing.T) {
+	l := &recordingLogger{}
+	q, _ := NewQueueWithOptions(1, WithLogger(l))
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	q.Add(ctx, func(context.Context) { panic("boom") })
+	// The backlog message is logged before Add returns.
+	if msg := "debug: goqueue: task 2 backlogged, backlog length 1"; !l.has(msg) {
+		t.Errorf("missing log message %q in %q", msg, l.messages)
+	}
+	close(unblock)
+	<-q.Idle()
+
+	for _, msg := range []string{
+		"debug: goqueue: task 1 started",
+		"debug: goqueue: task 2 started",
+		"warn: goqueue: task 2 panicked: boom",
+	} {
+		if !l.has(msg) {
+			t.Errorf("missing log message %q in %q", msg, l.messages)
+		}
+	}
+}
+
+func TestWithContextEnricher(t *testing.T) {
+	type attemptKey struct{}
+	q, _ := NewQueueWithOptions(1, WithContextEnricher(func(ctx context.Context, attempt int) context.Context {
+		return context.WithValue(ctx, attemptKey{}, attempt)
+	}))
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var attempts []int
+	record := func(ctx context.Context) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, ctx.Value(attemptKey{}).(int))
+	}
+	q.Add(ctx, record)
+	<-q.Idle()
+	q.AddRetry(ctx, func(ctx context.Context) error {
+		record(ctx)
+		if _, ok := TaskIDFromContext(ctx); !ok {
+			t.Errorf("enriched context lost the task ID")
+		}
+		return errors.New("fail")
+	}, 3, nil)
+	<-q.Idle()
+
+	if got := fmt.Sprint(attempts); got != "[1 1 2 3]" {
+		t.Errorf("attempts = %s, want [1 1 2 3]", got)
+	}
+
+	// Functions submitted from an enriched context are still treated as
+	// submitted with the parent's context, so they are not discarded
+	// when the parent returns.
+	var ran atomic.Int32
+	q.AddRecursive(ctx, func(ctx context.Context, q *Queue) {
+		ran.Add(1)
+		q.Add(ctx, func(ctx context.Context) {
+			if ctx.Value(attemptKey{}) == nil {
+				t.Errorf("follow-up function was not enriched")
+			}
+			ran.Add(1)
+		})
+	})
+	<-q.Idle()
+	if n := ran.Load(); n != 2 {
+		t.Errorf("%d of 2 functions ran", n)
+	}
+}
@@ -5,30 +5,317 @@
 // executed in first-in-first-out (FIFO) order as running functions complete.
 //
 // The zero value of Queue is not usable. Use NewQueue to construct a Queue.
+//
+// # Submission errors
+//
+// Submission methods with an error result report a function that was not
+// accepted with one of the package's sentinel errors, which may be tested
+// with errors.Is. Once Drain or DrainWithProgress has been called, every
+// submission fails with ErrDraining; once the Queue is closed by Close,
+// Shutdown or ShutdownNow, or by the context given to
+// NewQueueWithContext, every submission fails with ErrClosed. These take
+// precedence over any other reason a function could be rejected.
+//
+// Submission methods without an error result, such as Add, AddPriority
+// and AddAfter, discard a function that cannot be accepted: they neither
+// panic nor block. Enqueue is the error-reporting form of Add.
 package goqueue
 
 import (
-	"container/list"
 	"context"
+	"errors"
 	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"time"
 )
 
+// ErrBacklogFull is returned when a function is submitted to a bounded
+// Queue whose backlog is already at capacity.
+var ErrBacklogFull = errors.New("goqueue: backlog full")
+
+// ErrQuotaExceeded is returned when a function is submitted to a Queue
+// that has already accepted as many functions as WithMaxSubmissions
+// allows.
+var ErrQuotaExceeded = errors.New("goqueue: submission quota exceeded")
+
+// ErrTooHeavy is returned when a function submitted with AddWeighted has
+// a weight greater than the Queue's concurrency limit.
+var ErrTooHeavy = errors.New("goqueue: weight exceeds concurrency limit")
+
+// ErrDraining is returned when a function is submitted to a Queue that is
+// being, or has been, drained.
+var ErrDraining = errors.New("goqueue: queue is draining")
+
+// ErrClosed is returned when a function is submitted to a Queue that has
+// been closed.
+var ErrClosed = errors.New("goqueue: queue is closed")
+
+// ErrCanceled is reported for a function that was removed from the
+// backlog by Cancel before it could run.
+var ErrCanceled = errors.New("goqueue: canceled")
+
+// ErrWaitTimeout is returned by AddWaitTimeout when a function does not start
+// within the allotted time.
+var ErrWaitTimeout = errors.New("goqueue: timed out waiting for a slot")
+
+// ErrWouldDeadlock is returned by AddWait, AddWaitTimeout and
+// SubmitAndWait when they are called from a function running on the same
+// Queue and the submitted function cannot start at once.
+var ErrWouldDeadlock = errors.New("goqueue: blocking submission from a running function")
+
+// ErrNotRunning is returned by Yield when it is not called with the
+// context of a running function.
+var ErrNotRunning = errors.New("goqueue: not called from a running function")
+
+// ErrBusy is returned by Reset when the Queue is not idle.
+var ErrBusy = errors.New("goqueue: queue is busy")
+
+// ErrPanicked is reported for a function that panicked instead of
+// returning normally.
+var ErrPanicked = errors.New("goqueue: function panicked")
+
+// A ShutdownError is returned by ShutdownGraceful when functions were
+// still running at the end of the grace period and had their contexts
+// cancelled.
+type ShutdownError struct {
+	Cancelled int // number of functions whose contexts were cancelled
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("goqueue: %d functions cancelled after the shutdown grace period", e.Cancelled)
+}
+
+// PanicHandler is called with the recovered value and the goroutine's
+// stack trace when a function run by a Queue panics.
+type PanicHandler func(recovered any, stack []byte)
+
+// ErrorHandler is called with the non-nil error returned by a function
+// submitted with AddErr.
+type ErrorHandler func(error)
+
+// DroppedHandler is called with the context of a backlogged function that
+// was discarded without running because its context was done, or its
+// deadline had passed, by the time it reached the front of the backlog.
+type DroppedHandler func(ctx context.Context)
+
 // Queue represents a concurrency-limited FIFO work queue.
 //
 // A Queue guarantees that at most maxActive functions are running at any
 // given time. If the limit has been reached, additional functions submitted
-// with Add are placed in a backlog and executed in submission order.
+// with Add are placed in a backlog and executed in submission order, after
+// any backlogged functions of higher priority.
+//
+// Functions of equal priority submitted by one goroutine always start in
+// the order they were submitted; with a limit of 1 they therefore also run
+// to completion in that order.
 //
 // Queue is safe for concurrent use by multiple goroutines.
 type Queue struct {
-	maxActive int
-	st        chan queueState
+	maxBacklog     int   // negative means unbounded
+	maxSubmissions int64 // negative means unlimited
+	clock          Clock
+	st             chan queueState
 }
 
 type queueState struct {
-	active  int
-	backlog *list.List
-	idle    chan struct{}
+	maxActive int
+	ceiling   int // upper bound on maxActive; 0 means none
+	hard      int // limit for PriorityHigh functions, if above maxActive
+	active    int
+	delayed   int // functions submitted with AddAfter still waiting out their delay
+	// halt is closed by abandon, to discard the functions counted by
+	// delayed without waiting for their delays.
+	halt     chan struct{}
+	backlog  *backlog
+	running  *task       // head of the list of running tasks
+	shared   *runContext // most recently derived run context, for reuse
+	idle     chan struct{}
+	draining bool
+	closed   bool
+	shutdown bool // set by Shutdown: pending work is abandoned
+	// terminated is set once the context of NewQueueWithContext is done;
+	// from then on the Queue counts as idle.
+	terminated bool
+	paused     bool // set by Pause: backlogged functions are not started
+
+	// gen is the generation of new submissions: the number of barriers
+	// submitted so far. fences holds the barriers that have not yet
+	// started, oldest first; fenced is set while one runs.
+	gen    int64
+	fences []*task
+	fenced bool
+	// alone is set while a function submitted by AddExclusive runs.
+	alone bool
+
+	// keyed holds, for each key with a function submitted by AddKeyed
+	// that has not yet finished, the functions waiting for that key.
+	keyed     map[string][]*task
+	parked    int // number of functions waiting in keyed
+	completed int64
+	// completions, if non-nil, receives a value for each completed
+	// function, as long as it has room; see Completions.
+	completions chan struct{}
+	throughput  *throughputRing // recent completions, for RecentThroughput
+	avgWait     time.Duration   // moving average of backlog wait times
+	waited      bool            // whether avgWait has been initialized
+	seq         int64           // sequence number of the most recently accepted task
+	root        context.Context // set by NewQueueWithContext; nil otherwise
+
+	hooks        hooks
+	errorHandler ErrorHandler
+	limiter      *rateLimiter // nil if starts are not rate limited
+	// budget, if non-nil, is the Limiter set by WithSharedLimiter, and
+	// owner the Queue that st belongs to, for budget to wake.
+	budget *Limiter
+	owner  *Queue
+	jitter time.Duration // upper bound on the random delay before each start
+
+	// pool, if non-nil, is received from by idle pooled workers, of which
+	// workers are started; workers is 0 unless WithWorkerPool is enabled.
+	pool    chan job
+	workers int
+
+	// events holds the tasks backlogged while st was held, for unlock to
+	// log once it is released; it stays nil without a Logger.
+	events []backlogEvent
+}
+
+// backlogEvent records that the task with sequence number seq was
+// backlogged, leaving len functions in the backlog.
+type backlogEvent struct {
+	seq int64
+	len int
+}
+
+// job is a task handed to a pooled worker, with the arguments to run.
+type job struct {
+	t    *task
+	h    hooks
+	wait time.Duration
+}
+
+// hooks are the callbacks a Queue invokes around each function it runs.
+// A running goroutine takes a copy whenever it acquires the state, so
+// changes take effect from the next function started.
+type hooks struct {
+	onStart      func(context.Context)
+	onComplete   func(context.Context, time.Duration)
+	panicHandler PanicHandler
+	collector    Collector
+	logger       Logger
+	enrich       func(context.Context, int) context.Context
+	dropped      DroppedHandler
+	runs         *durationHistogram // nil unless WithRunDurationBuckets
+	contextDone  func(context.Context)
+}
+
+// task is a unit of work submitted to a Queue.
+type task struct {
+	ctx      context.Context
+	f        func(context.Context)
+	priority Priority
+	weight   int   // slots occupied while running; 0 means 1
+	gen      int64 // number of barriers submitted before t
+	seq      int64
+	since    time.Time // when t entered the backlog, then when it was given a slot
+
+	barrier   bool // whether t was submitted by Barrier
+	exclusive bool // whether t was submitted by AddExclusive
+
+	// prev and next link t into its backlog list while backlogged is set.
+	prev, next *task
+	backlogged bool
+
+	// x holds the fields that only some submitters set; it is nil for a
+	// function submitted by Add, which need not carry them.
+	x *taskExtra
+
+	// run holds the context f is called with once t has started. It is
+	// derived from ctx so that the Queue can cancel t while it runs.
+	run *runContext
+
+	// idCtx is the context t's function is called with: run's context
+	// carrying t's ID. It is stored in t to avoid a separate allocation.
+	idCtx taskContext
+
+	// prevRun and nextRun link t into its Queue's list of running tasks.
+	prevRun, nextRun *task
+}
+
+// taskExtra holds the rarely used fields of a task.
+type taskExtra struct {
+	// key identifies the task in the backlog if unique is set.
+	key    string
+	unique bool
+
+	// label describes the task for PeekLabels.
+	label string
+
+	// payload is the value submitted with AddPayload, for PendingPayloads.
+	payload any
+
+	// attempt is the number of the call to a function submitted by
+	// AddRetry that the task makes; 0 means 1.
+	attempt int
+
+	// started, if non-nil, is closed when the task leaves the backlog
+	// and begins executing.
+	started chan struct{}
+
+	// dropped, if non-nil, is called with the reason when the task is
+	// discarded without running. It may be called with the state held and
+	// must not block.
+	dropped func(error)
+}
+
+// extra returns t's taskExtra, allocating it if necessary. It must only be
+// called before t is submitted.
+func (t *task) extra() *taskExtra {
+	if t.x == nil {
+		t.x = new(taskExtra)
+	}
+	return t.x
+}
+
+// label returns t's label, or "" if it has none.
+func (t *task) label() string {
+	if t.x == nil {
+		return ""
+	}
+	return t.x.label
+}
+
+// payload returns t's payload, or nil if it has none.
+func (t *task) payload() any {
+	if t.x == nil {
+		return nil
+	}
+	return t.x.payload
+}
+
+// attempt returns the number of t's AddRetry attempt, counting from 1.
+func (t *task) attempt() int {
+	if t.x == nil {
+		return 1
+	}
+	return max(t.x.attempt, 1)
+}
+
+// drop calls t's dropped callback, if any, with err.
+func (t *task) drop(err error) {
+	if t.x != nil && t.x.dropped != nil {
+		t.x.dropped(err)
+	}
+}
+
+// markStarted closes t's started channel, if any.
+func (t *task) markStarted() {
+	if t.x != nil && t.x.started != nil {
+		close(t.x.started)
+	}
 }
 
 // NewQueue creates a new Queue that allows at most maxActive functions
@@ -37,86 +324,2258 @@ type queueState struct {
 // maxActive must be greater than zero. If maxActive is less than 1,
 // NewQueue returns an error.
 func NewQueue(maxActive int) (*Queue, error) {
+	return NewQueueWithOptions(maxActive)
+}
+
+// NewSerialQueue creates a new Queue that runs its functions strictly one
+// at a time, in FIFO order among functions of equal priority: each
+// function starts only after the previous one has returned, so functions
+// may share state without further locking.
+//
+// The limit of one cannot be raised: SetMaxActive with a larger limit
+// returns an error, and AddWeighted with a weight above 1 returns
+// ErrTooHeavy.
+func NewSerialQueue() *Queue {
+	q, err := NewQueueWithOptions(1, WithMaxActiveCeiling(1))
+	if err != nil {
+		panic(err) // unreachable: a limit of 1 is always valid
+	}
+	return q
+}
+
+// NewBoundedQueue creates a new Queue that allows at most maxActive
+// functions to run concurrently and at most maxBacklog functions to wait
+// in the backlog.
+//
+// When the backlog is full, Enqueue and AddWait return ErrBacklogFull
+// instead of accepting the function. A maxBacklog of 0 allows no backlog
+// at all: a function is only accepted if a slot is free. A negative
+// maxBacklog means the backlog is unbounded, as with NewQueue.
+//
+// maxActive must be greater than zero. If maxActive is less than 1,
+// NewBoundedQueue returns an error.
+func NewBoundedQueue(maxActive, maxBacklog int) (*Queue, error) {
+	return NewQueueWithOptions(maxActive, WithMaxBacklog(maxBacklog))
+}
+
+// NewQueueWithOptions creates a new Queue that allows at most maxActive
+// functions to run concurrently, configured by opts.
+//
+// maxActive must be greater than zero. If maxActive is less than 1,
+// NewQueueWithOptions returns an error.
+func NewQueueWithOptions(maxActive int, opts ...Option) (*Queue, error) {
 	if maxActive < 1 {
 		return nil, fmt.Errorf("goQueue called with nonpositive limit (%d)", maxActive)
 	}
 
-	q := &Queue{maxActive: maxActive, st: make(chan queueState, 1)}
-	q.st <- queueState{backlog: list.New()}
+	o := options{maxBacklog: -1, maxSubmissions: -1}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.clock == nil {
+		o.clock = realClock{}
+	}
+	if o.hard != 0 && o.hard < maxActive {
+		return nil, fmt.Errorf("goQueue called with hard limit %d below limit %d", o.hard, maxActive)
+	}
+	if o.ceiling > 0 && maxActive > o.ceiling {
+		return nil, fmt.Errorf("goQueue called with limit %d above ceiling %d", maxActive, o.ceiling)
+	}
+
+	st := queueState{
+		maxActive:    maxActive,
+		ceiling:      o.ceiling,
+		hard:         o.hard,
+		backlog:      newBacklog(&o),
+		hooks:        o.hooks,
+		errorHandler: o.errorHandler,
+		jitter:       o.jitter,
+		halt:         make(chan struct{}),
+		throughput:   new(throughputRing),
+	}
+	if o.rateN != 0 || o.ratePer != 0 {
+		if o.rateN < 1 || o.ratePer <= 0 {
+			return nil, fmt.Errorf("goQueue called with invalid rate limit (%d per %v)", o.rateN, o.ratePer)
+		}
+		st.limiter = newRateLimiter(o.rateN, o.ratePer, o.clock.Now())
+	}
+
+	q := &Queue{
+		maxBacklog:     o.maxBacklog,
+		maxSubmissions: o.maxSubmissions,
+		clock:          o.clock,
+		st:             make(chan queueState, 1),
+	}
+	if o.shared != nil {
+		st.budget, st.owner = o.shared, q
+	}
+	if o.workerPool {
+		st.workers = maxActive
+		q.startPool(&st)
+	}
+	q.st <- st
+	return q, nil
+}
+
+// NewQueueWithContext is like NewQueue, but the Queue is tied to ctx.
+//
+// Once ctx is done, the Queue is terminated. It behaves as if Shutdown had
+// been called without waiting: it rejects new functions with ErrClosed and
+// discards its backlog, so that each worker goroutine exits as soon as its
+// current function returns. Functions already running are not
+// interrupted. In addition, the Queue counts as idle from then on, even
+// while those functions are still running: Idle's channel is closed, and
+// Wait and Drain return, so that a single select on Idle observes both
+// normal completion and cancellation. A terminated Queue cannot be used
+// again.
+func NewQueueWithContext(ctx context.Context, maxActive int) (*Queue, error) {
+	q, err := NewQueue(maxActive)
+	if err != nil {
+		return nil, err
+	}
+	st := <-q.st
+	st.root = ctx
+	q.st <- st
+	context.AfterFunc(ctx, func() {
+		st := <-q.st
+		st.checkRoot()
+		q.st <- st
+	})
 	return q, nil
 }
+
 // Add submits a function to the Queue for execution.
 //
 // If fewer than the maximum number of functions are currently running,
-// f is executed immediately in its own goroutine. Otherwise, f is added
-// to the backlog and will be executed in FIFO order when capacity becomes
-// available.
+// f is executed immediately, in a new goroutine or, with WithWorkerPool,
+// on a pooled worker. Otherwise, f is added to the backlog and will be
+// executed in FIFO order when capacity becomes available.
 //
-// The provided context is passed to the function when it executes.
+// When f executes, it is called with a context derived from ctx: it
+// carries ctx's values and is cancelled when ctx is, whether f started
+// immediately or from the backlog, so f need only watch the context it is
+// given. The Queue cancels that context once f has returned and no other
+// function submitted with the same ctx is still running, so resources
+// tied to it are released without the caller cancelling ctx; see
+// WithOnTaskContextDone. Functions that f submits with it are treated as
+// submitted with ctx, so they are not discarded when f returns. If ctx is
+// done before a backlogged f gets a slot, f is discarded without running.
 // Add does not block waiting for execution to begin.
 //
-// The function f must not panic. If f panics, the behavior of the Queue
-// is undefined.
+// If the Queue was created by NewBoundedQueue and its backlog is full,
+// or if the Queue is draining or closed, f is discarded. Use Enqueue to
+// detect this.
+//
+// If f panics, the panic is recovered and reported to the Queue's
+// PanicHandler, if any, and the Queue continues with the next function.
+//
+// Add, and every other method that submits a function, panics if the
+// function is nil.
 func (q *Queue) Add(ctx context.Context, f func(context.Context)) {
+	q.AddPriority(ctx, PriorityNormal, f)
+}
+
+// nilFunc is the panic value for a nil function passed to a Queue. Each
+// submitter checks its function before accepting it, so that the mistake
+// is reported by the call that submitted it rather than by a worker
+// goroutine when it runs.
+const nilFunc = "goqueue: nil function"
+
+// AddSimple is like Add for a function that does not use its context. f
+// is run with a background context, so it is never discarded for a done
+// context.
+func (q *Queue) AddSimple(f func()) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	q.Add(context.Background(), func(context.Context) { f() })
+}
+
+// AddRecursive is like Add, but f is also passed the Queue, so that it can
+// submit follow-up work.
+//
+// Functions never run with the Queue's internal lock held, so f may call
+// any method of the Queue, including submitting more functions, which
+// the Queue stays busy for: it does not become idle until f and
+// everything f submitted have finished. f must not wait for the Queue to
+// become idle, as by Wait or Drain, since it is itself keeping it busy.
+func (q *Queue) AddRecursive(ctx context.Context, f func(ctx context.Context, q *Queue)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	q.Add(ctx, func(ctx context.Context) { f(ctx, q) })
+}
+
+// AddSeq is like Add, but returns the sequence number assigned to f.
+//
+// Every function accepted by the Queue, by any method, is assigned the
+// next number in a sequence starting at 1, so sequence numbers reflect the
+// order in which functions were accepted across all goroutines. AddSeq
+// returns 0 if f was not accepted.
+func (q *Queue) AddSeq(ctx context.Context, f func(context.Context)) int64 {
+	if f == nil {
+		panic(nilFunc)
+	}
+	t := &task{ctx: ctx, f: f}
+	if _, err := q.add(t); err != nil {
+		return 0
+	}
+	return t.seq
+}
+
+// A Submission describes how the Queue accepted a function submitted by
+// Submit.
+type Submission struct {
+	// Seq is the function's sequence number, as returned by AddSeq, or 0
+	// if the function was not accepted.
+	Seq int64
+	// Started reports whether the function was given a slot at once
+	// rather than backlogged. A started function may still wait for the
+	// rate limiter, if any, before it runs. Started is false if the
+	// function was not accepted.
+	Started bool
+}
+
+// Submit is like Add, but reports the function's sequence number and
+// whether it started at once or went to the backlog.
+func (q *Queue) Submit(ctx context.Context, f func(context.Context)) Submission {
+	if f == nil {
+		panic(nilFunc)
+	}
+	t := &task{ctx: ctx, f: f}
+	queued, err := q.add(t)
+	if err != nil {
+		return Submission{}
+	}
+	return Submission{Seq: t.seq, Started: !queued}
+}
+
+// AddDone is like Add, but returns a channel that is closed once f has
+// finished executing.
+//
+// The channel is also closed if f never runs: if it is rejected by the
+// Queue, if ctx is done before it starts, or if it is discarded from the
+// backlog by Cancel or Shutdown. Use it to wait for an individual function
+// rather than the whole Queue.
+func (q *Queue) AddDone(ctx context.Context, f func(context.Context)) <-chan struct{} {
+	if f == nil {
+		panic(nilFunc)
+	}
+	done := make(chan struct{})
+	_, err := q.add(&task{
+		ctx: ctx,
+		f: func(ctx context.Context) {
+			defer close(done)
+			f(ctx)
+		},
+		x: &taskExtra{dropped: func(error) { close(done) }},
+	})
+	if err != nil {
+		close(done)
+	}
+	return done
+}
+
+// AddPriority is like Add, but f is backlogged at the given priority.
+//
+// When a slot becomes available, the oldest backlogged function of the
+// highest priority is started next. Add uses PriorityNormal. A priority
+// outside the range PriorityLow to PriorityHigh is treated as the nearest
+// defined level.
+func (q *Queue) AddPriority(ctx context.Context, priority Priority, f func(context.Context)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	q.add(&task{ctx: ctx, f: f, priority: priority.clamp()})
+}
+
+// AddWithTimeout is like Add, but f is passed a context that is cancelled
+// once timeout has elapsed since f began executing.
+//
+// Time spent waiting in the backlog does not count against timeout.
+func (q *Queue) AddWithTimeout(ctx context.Context, timeout time.Duration, f func(context.Context)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	q.Add(ctx, func(ctx context.Context) {
+		ctx, cancel := withTimeout(ctx, q.clock, timeout)
+		defer cancel()
+		f(ctx)
+	})
+}
+
+// AddWithValues is like Add, but the context passed to f, and to the
+// start and completion hooks run for it, also carries values: looking up
+// one of its keys with Value returns the corresponding value. The map is
+// copied, so later changes to it do not affect f, and the values are
+// visible only to this function. As with context.WithValue, the keys must
+// be comparable.
+func (q *Queue) AddWithValues(ctx context.Context, values map[any]any, f func(context.Context)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	vals := make(map[any]any, len(values))
+	for k, v := range values {
+		vals[k] = v
+	}
+	q.Add(&valuesContext{Context: ctx, values: vals}, f)
+}
+
+// valuesContext is a context carrying a set of values, like a chain of
+// context.WithValue calls.
+type valuesContext struct {
+	context.Context
+	values map[any]any
+}
+
+func (c *valuesContext) Value(key any) any {
+	if v, ok := c.values[key]; ok {
+		return v
+	}
+	return c.Context.Value(key)
+}
+
+// AddAfter is like Add, but f is not submitted until delay has elapsed.
+//
+// While it waits out the delay, f occupies no slot and is not counted by
+// BacklogLen, but the Queue is not idle. If ctx is done before the delay
+// elapses, f is discarded. Once the delay elapses f is submitted as if by
+// Add, except that it is still accepted if the Queue has since begun
+// draining or been closed.
+func (q *Queue) AddAfter(ctx context.Context, delay time.Duration, f func(context.Context)) {
+	if f == nil {
+		panic(nilFunc)
+	}
 	st := <-q.st
-	if st.active == q.maxActive {
-		st.backlog.PushBack(f)
+	if st.rejecting() != nil {
 		q.st <- st
 		return
 	}
+	q.schedule(&st, delay, &task{ctx: submittedContext(ctx), f: f})
+	q.st <- st
+}
 
-	if st.active == 0 {
+// schedule submits t once delay has elapsed, as described for AddAfter.
+// The caller must hold st.
+func (q *Queue) schedule(st *queueState, delay time.Duration, t *task) {
+	if st.shutdown {
+		return
+	}
+	if st.isIdle() {
 		// Mark q as non-idle
 		st.idle = nil
 	}
-
-	st.active++
-	q.st <- st
+	st.delayed++
+	halt := st.halt
 
 	go func() {
-		for {
-			f(ctx)
+		timer := q.clock.NewTimer(delay)
+		defer timer.Stop()
+		var elapsed bool
+		select {
+		case <-timer.C():
+			elapsed = true
+		case <-t.ctx.Done():
+		case <-halt:
+			return
+		}
 
-			st := <-q.st
-			if st.backlog.Len() == 0 {
-				if st.active--; st.active == 0 && st.idle != nil {
-					close(st.idle)
-				}
-				q.st <- st
-				return
-			}
-			f = st.backlog.Remove(st.backlog.Front()).(func(context.Context))
+		st := <-q.st
+		st.checkRoot()
+		if st.shutdown {
+			// abandon has already discounted t.
 			q.st <- st
+			return
 		}
+		if elapsed {
+			q.accept(&st, t)
+		}
+		st.delayed--
+		st.signalIdle()
+		q.unlock(st)
 	}()
+}
 
+// AddErr is like Add for a function that can fail. If f returns a non-nil
+// error, it is passed to the Queue's ErrorHandler, if any.
+//
+// The ErrorHandler is called on the goroutine that ran f, after f returns.
+func (q *Queue) AddErr(ctx context.Context, f func(context.Context) error) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	q.Add(ctx, func(ctx context.Context) {
+		if err := f(ctx); err != nil {
+			q.handleError(err)
+		}
+	})
 }
 
-// Idle returns a channel that is closed when the Queue becomes idle.
+// AddCallback is like Add for a function with a result: once f returns,
+// cb is called with its result. cb runs in a goroutine of its own rather
+// than in f's slot, so a slow callback does not hold up the Queue.
 //
-// The returned channel is closed when there are no active functions running
-// and the backlog is empty. If the Queue is already idle at the time of the
-// call, the returned channel is already closed.
+// cb is called exactly once for every call to AddCallback, so that the
+// caller always learns how f ended. If f is rejected by the Queue, or is
+// discarded without running because ctx was done first or the backlog was
+// cancelled, cb is called with a nil result and the corresponding error,
+// as for a ResultQueue. If f panics, cb is called with ErrPanicked.
+func (q *Queue) AddCallback(ctx context.Context, f func(context.Context) (any, error), cb func(any, error)) {
+	if f == nil || cb == nil {
+		panic(nilFunc)
+	}
+	fail := func(err error) { go cb(nil, err) }
+	_, err := q.add(&task{
+		ctx: ctx,
+		f: func(ctx context.Context) {
+			var v any
+			err := ErrPanicked
+			defer func() { go cb(v, err) }()
+			v, err = f(ctx)
+		},
+		x: &taskExtra{dropped: fail},
+	})
+	if err != nil {
+		fail(err)
+	}
+}
+
+// AddRetry is like AddErr, but a failed f is retried until it succeeds
+// or has been called attempts times. Only the error from the final attempt
+// is passed to the Queue's ErrorHandler.
 //
-// Multiple calls to Idle may return the same channel while the Queue
-// remains non-idle.
-func (q *Queue) Idle() <-chan struct{} {
-	st := <-q.st
-	defer func() { q.st <- st }()
-	if st.idle == nil {
-		st.idle = make(chan struct{})
-		if st.active == 0 {
-			close(st.idle)
+// After the n-th failed attempt, f is resubmitted as if by AddAfter with a
+// delay of backoff(n), so it holds no slot while it waits. A nil backoff
+// retries without delay. Retries are accepted even if the Queue has since
+// begun draining or been closed. If ctx is done, f is not retried and the
+// most recent error is reported; a retry discarded while waiting for its
+// slot is not reported.
+//
+// An attempts value less than 1 is treated as 1.
+func (q *Queue) AddRetry(ctx context.Context, f func(context.Context) error, attempts int, backoff func(attempt int) time.Duration) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	q.Add(ctx, q.attempt(ctx, f, 1, attempts, backoff))
+}
+
+// attempt returns the function that makes attempt number n of a function
+// submitted with AddRetry.
+func (q *Queue) attempt(ctx context.Context, f func(context.Context) error, n, attempts int, backoff func(int) time.Duration) func(context.Context) {
+	return func(runCtx context.Context) {
+		err := f(runCtx)
+		if err == nil {
+			return
+		}
+		if n >= attempts || ctx.Err() != nil {
+			q.handleError(err)
+			return
 		}
+		var delay time.Duration
+		if backoff != nil {
+			delay = backoff(n)
+		}
+		st := <-q.st
+		q.schedule(&st, delay, &task{ctx: ctx, f: q.attempt(ctx, f, n+1, attempts, backoff), x: &taskExtra{attempt: n + 1}})
+		q.st <- st
 	}
-	return st.idle
 }
 
-// BacklogLen returns the number of functions currently waiting in the backlog.
+// AddLabeled is like Add, but attaches label to f for as long as f waits
+// in the backlog. See PeekLabels.
+func (q *Queue) AddLabeled(ctx context.Context, label string, f func(context.Context)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	q.add(&task{ctx: ctx, f: f, x: &taskExtra{label: label}})
+}
+
+// AddPayload is like Add, but attaches payload to f. The Queue does not
+// interpret payload; it is reported by PendingPayloads while f waits in
+// the backlog, so that the caller can reconstruct f from it.
+func (q *Queue) AddPayload(ctx context.Context, payload any, f func(context.Context)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	q.add(&task{ctx: ctx, f: f, x: &taskExtra{payload: payload}})
+}
+
+// handleError reports err to q's ErrorHandler, if any.
+func (q *Queue) handleError(err error) {
+	st := <-q.st
+	h := st.errorHandler
+	q.st <- st
+	if h != nil {
+		h(err)
+	}
+}
+
+// AddWeighted is like Enqueue, but f occupies weight slots of the
+// concurrency limit while it runs, rather than one. It starts only once
+// enough slots are free; functions submitted after it wait behind it.
 //
-// This does not include functions that are actively running.
-func (q *Queue) BacklogLen() int64 {
+// If weight is greater than the Queue's concurrency limit, AddWeighted
+// returns ErrTooHeavy. A weight less than 1 is treated as 1.
+func (q *Queue) AddWeighted(ctx context.Context, weight int, f func(context.Context)) error {
+	if f == nil {
+		panic(nilFunc)
+	}
 	st := <-q.st
-	defer func() { q.st <- st }()
-	return int64(st.backlog.Len())
+	defer func() { q.unlock(st) }()
+	if err := st.rejecting(); err != nil {
+		return err
+	}
+	if weight > st.maxActive {
+		return ErrTooHeavy
+	}
+	_, err := q.submit(&st, &task{ctx: ctx, f: f, weight: weight})
+	return err
+}
+
+// AddExclusive is like Add, but f runs with no other function running on
+// the Queue. When f reaches the front of the backlog, it waits for the
+// functions already running to finish, and nothing else starts until f
+// has returned, after which the Queue resumes its normal concurrency.
+//
+// Unlike Barrier, f does not wait for the rest of the backlog: it takes
+// its turn in priority and FIFO order like any other function, so a
+// higher-priority function submitted later may start first, and the
+// functions behind f wait only while f waits and runs.
+func (q *Queue) AddExclusive(ctx context.Context, f func(context.Context)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	q.add(&task{ctx: ctx, f: f, exclusive: true})
+}
+
+// Enqueue is like Add but reports whether f was accepted.
+//
+// If the backlog of a bounded Queue is full, f is not enqueued and
+// Enqueue returns ErrBacklogFull. If the Queue's submission quota is used
+// up, Enqueue returns ErrQuotaExceeded. If the Queue is draining or closed,
+// Enqueue returns ErrDraining or ErrClosed.
+func (q *Queue) Enqueue(ctx context.Context, f func(context.Context)) error {
+	if f == nil {
+		panic(nilFunc)
+	}
+	_, err := q.add(&task{ctx: ctx, f: f})
+	return err
+}
+
+// TryAdd is like Add, but reports whether f was started immediately.
+//
+// TryAdd returns false if f was placed in the backlog, or if it was
+// discarded because the Queue could not accept it. TryAdd never blocks.
+func (q *Queue) TryAdd(ctx context.Context, f func(context.Context)) (started bool) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	queued, err := q.add(&task{ctx: ctx, f: f})
+	return !queued && err == nil
+}
+
+// AddCancelable is like Add, but returns a Handle that can be used to
+// withdraw f while it is still waiting in the backlog.
+func (q *Queue) AddCancelable(ctx context.Context, f func(context.Context)) *Handle {
+	if f == nil {
+		panic(nilFunc)
+	}
+	t := &task{ctx: ctx, f: f}
+	q.add(t)
+	return &Handle{q: q, t: t}
+}
+
+// A Handle refers to a function submitted with AddCancelable.
+type Handle struct {
+	q *Queue
+	t *task
+}
+
+// Cancel removes the function from the backlog so that it never runs, and
+// reports whether it did so. Cancel returns false if the function has
+// already started, has been discarded, or was never accepted.
+func (h *Handle) Cancel() bool {
+	st := <-h.q.st
+	defer func() { h.q.st <- st }()
+	if !st.backlog.remove(h.t) {
+		return false
+	}
+	st.signalIdle()
+	return true
+}
+
+// AddWithCancel is like Add, but f runs with a context derived from
+// runCtx, a cancelable child of parent, and AddWithCancel returns runCtx
+// with its cancel function.
+//
+// Calling cancel withdraws f if it is still in the backlog, as by
+// Handle.Cancel, and otherwise cancels the context f is running with.
+// cancel may be called more than once, and from any goroutine. runCtx is
+// also cancelled once f returns or is discarded, so it is not leaked if
+// cancel is never called; if f was not accepted at all, runCtx is already
+// cancelled when AddWithCancel returns.
+func (q *Queue) AddWithCancel(parent context.Context, f func(context.Context)) (runCtx context.Context, cancel context.CancelFunc) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	runCtx, cancelRun := context.WithCancel(submittedContext(parent))
+	t := &task{
+		ctx: runCtx,
+		f: func(ctx context.Context) {
+			defer cancelRun()
+			f(ctx)
+		},
+		x: &taskExtra{dropped: func(error) { cancelRun() }},
+	}
+	if _, err := q.add(t); err != nil {
+		cancelRun()
+		return runCtx, cancelRun
+	}
+	h := &Handle{q: q, t: t}
+	return runCtx, func() {
+		h.Cancel()
+		cancelRun()
+	}
+}
+
+// AddUnique is like Add, but f is not submitted if a function submitted
+// with AddUnique for the same key is still waiting in the backlog. It
+// reports whether f was accepted.
+//
+// Only backlogged functions are considered: once a function has started,
+// another with the same key may be submitted.
+func (q *Queue) AddUnique(ctx context.Context, key string, f func(context.Context)) bool {
+	if f == nil {
+		panic(nilFunc)
+	}
+	st := <-q.st
+	defer func() { q.unlock(st) }()
+	if st.backlog.hasKey(key) {
+		return false
+	}
+	_, err := q.submit(&st, &task{ctx: ctx, f: f, x: &taskExtra{key: key, unique: true}})
+	return err == nil
+}
+
+// AddAll submits each function in fs as if by Add, in order, while
+// acquiring the Queue's internal lock only once.
+//
+// As many functions as there are free slots are started immediately; the
+// rest are added to the backlog in the order they appear in fs.
+func (q *Queue) AddAll(ctx context.Context, fs []func(context.Context)) {
+	for _, f := range fs {
+		if f == nil {
+			panic(nilFunc)
+		}
+	}
+	st := <-q.st
+	defer func() { q.unlock(st) }()
+	for _, f := range fs {
+		q.submit(&st, &task{ctx: ctx, f: f})
+	}
+}
+
+// AddN submits n functions that call f with the indexes 0 through n-1,
+// as if by AddAll: in index order, while acquiring the Queue's internal
+// lock only once. Together with Wait, it makes a bounded parallel loop.
+func (q *Queue) AddN(ctx context.Context, n int, f func(ctx context.Context, i int)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	st := <-q.st
+	defer func() { q.unlock(st) }()
+	for i := 0; i < n; i++ {
+		q.submit(&st, &task{ctx: ctx, f: func(ctx context.Context) { f(ctx, i) }})
+	}
+}
+
+// AddWait submits a function to the Queue and blocks until it has begun
+// executing in an active slot, or until ctx is done.
+//
+// Unlike Add, AddWait applies backpressure to the caller: while the Queue
+// is at capacity, f waits its turn in the backlog in FIFO order with other
+// submissions and AddWait does not return. If ctx is done before f starts,
+// even when AddWait is called, f does not run and AddWait returns
+// ctx.Err(). Once f has started, AddWait returns nil; f continues to run
+// with ctx.
+//
+// If the backlog of a bounded Queue is full, AddWait returns
+// ErrBacklogFull immediately without waiting. If the Queue is draining or
+// closed, AddWait returns ErrDraining or ErrClosed. If f is removed from
+// the backlog by Cancel, AddWait returns ErrCanceled.
+//
+// A function running on the Queue that calls AddWait with its own context,
+// or one derived from it, holds a slot while it waits for one; if every
+// running function did so, none would ever return. AddWait therefore
+// never blocks such a caller: if f cannot start at once, it is not
+// submitted and AddWait returns ErrWouldDeadlock. The caller may submit it
+// with Add instead, which does not wait.
+func (q *Queue) AddWait(ctx context.Context, f func(context.Context)) error {
+	return q.addWait(ctx, f, nil)
+}
+
+// AddWaitTimeout is like AddWait, but gives up if f has not begun
+// executing after d. In that case f is removed from the backlog without
+// running, and AddWaitTimeout returns ErrWaitTimeout. Unlike a deadline on
+// ctx, d limits only the wait: once f starts, it runs with ctx unchanged.
+func (q *Queue) AddWaitTimeout(ctx context.Context, d time.Duration, f func(context.Context)) error {
+	timer := q.clock.NewTimer(d)
+	defer timer.Stop()
+	return q.addWait(ctx, f, timer.C())
+}
+
+// addWait is the body of AddWait. If expire is non-nil, addWait gives up
+// with ErrWaitTimeout once it receives from expire.
+func (q *Queue) addWait(ctx context.Context, f func(context.Context), expire <-chan time.Time) error {
+	if f == nil {
+		panic(nilFunc)
+	}
+	var (
+		dropped = make(chan struct{})
+		dropErr error
+	)
+	started := make(chan struct{})
+	t := &task{
+		ctx: ctx,
+		f:   f,
+		x: &taskExtra{
+			started: started,
+			dropped: func(err error) {
+				dropErr = err
+				close(dropped)
+			},
+		},
+	}
+	queued, err := q.addBlocking(t)
+	if !queued {
+		return err
+	}
+
+	var reason error
+	select {
+	case <-started:
+		return nil
+	case <-dropped:
+		return dropErr
+	case <-ctx.Done():
+		reason = ctx.Err()
+	case <-expire:
+		reason = ErrWaitTimeout
+	}
+
+	st := <-q.st
+	defer func() { q.st <- st }()
+	select {
+	case <-started:
+		// f was promoted before we reacquired the state.
+		return nil
+	case <-dropped:
+		return dropErr
+	default:
+	}
+	st.backlog.remove(t)
+	st.signalIdle()
+	return reason
+}
+
+// SubmitAndWait submits a function to the Queue and blocks until it has
+// finished executing.
+//
+// If ctx is done before f starts, even when SubmitAndWait is called, f
+// does not run and SubmitAndWait returns ctx.Err(). Once f has started,
+// SubmitAndWait waits for it to return, or to panic, and returns nil. If f
+// cannot be accepted, or is discarded without running for another reason,
+// SubmitAndWait returns the reason, as Enqueue and AddWait do. Like
+// AddWait, it returns ErrWouldDeadlock rather than wait when called from a
+// function running on the Queue.
+func (q *Queue) SubmitAndWait(ctx context.Context, f func(context.Context)) error {
+	if f == nil {
+		panic(nilFunc)
+	}
+	done := make(chan error, 1)
+	t := &task{
+		ctx: ctx,
+		f: func(ctx context.Context) {
+			defer func() { done <- nil }()
+			f(ctx)
+		},
+		x: &taskExtra{dropped: func(err error) { done <- err }},
+	}
+	if _, err := q.addBlocking(t); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	st := <-q.st
+	removed := st.backlog.remove(t)
+	st.signalIdle()
+	q.st <- st
+	if removed {
+		return ctx.Err()
+	}
+	return <-done
+}
+
+// add submits t for execution. If a slot is free, t is started in a new
+// goroutine; otherwise t is appended to the backlog and add reports true.
+// If t cannot be accepted, it is dropped and add returns the reason.
+func (q *Queue) add(t *task) (queued bool, err error) {
+	st := <-q.st
+	queued, err = q.submit(&st, t)
+	q.unlock(st)
+	return queued, err
+}
+
+// unlock releases st, then logs the tasks that were backlogged while it
+// was held. Every caller of accept releases st with unlock.
+func (q *Queue) unlock(st queueState) {
+	l, events := st.hooks.logger, st.events
+	st.events = nil
+	q.st <- st
+	for _, e := range events {
+		l.Debugf("goqueue: task %d backlogged, backlog length %d", e.seq, e.len)
+	}
+}
+
+// addBlocking is like add for a submitter that will wait for t to start.
+// It rejects t with its context's error if that is already done, and
+// with ErrWouldDeadlock if that submitter is itself running on q and t
+// would be backlogged.
+func (q *Queue) addBlocking(t *task) (queued bool, err error) {
+	st := <-q.st
+	defer func() { q.unlock(st) }()
+	if err := t.ctx.Err(); err != nil {
+		return false, err
+	}
+	if caller, ok := t.ctx.Value(taskKey{}).(*taskContext); ok && caller.q == q && st.isRunning(caller.t) {
+		if st.rejecting() == nil && (st.mustQueue(t) || !st.budgetFits(t)) {
+			return false, ErrWouldDeadlock
+		}
+	}
+	return q.submit(&st, t)
+}
+
+// submit is the body of add. The caller must hold st.
+func (q *Queue) submit(st *queueState, t *task) (queued bool, err error) {
+	if err := st.rejecting(); err != nil {
+		return false, err
+	}
+	return q.accept(st, t)
+}
+
+// rejecting returns ErrClosed or ErrDraining if st no longer takes
+// submissions, and nil otherwise. The caller must hold st.
+func (st *queueState) rejecting() error {
+	st.checkRoot()
+	if st.closed {
+		return ErrClosed
+	}
+	if st.draining {
+		return ErrDraining
+	}
+	return nil
+}
+
+// accept starts or backlogs t without checking whether q is still taking
+// submissions. The caller must hold st.
+func (q *Queue) accept(st *queueState, t *task) (queued bool, err error) {
+	if q.maxSubmissions >= 0 && st.seq >= q.maxSubmissions {
+		return false, ErrQuotaExceeded
+	}
+	queue := st.mustQueue(t) || !st.acquire(t)
+	if queue && q.maxBacklog >= 0 && st.backlog.len() >= q.maxBacklog {
+		return false, ErrBacklogFull
+	}
+
+	st.accepted(t)
+
+	if st.isIdle() {
+		// Mark q as non-idle
+		st.idle = nil
+	}
+
+	if queue {
+		t.since = q.clock.Now()
+		st.backlog.push(t)
+		if st.hooks.logger != nil {
+			st.events = append(st.events, backlogEvent{seq: t.seq, len: st.backlog.len()})
+		}
+		if t.priority == PriorityHigh && st.hard > st.maxActive {
+			// t may start in an overflow slot ahead of the backlog
+			// it joined.
+			q.fill(st)
+			return t.backlogged, nil
+		}
+		return true, nil
+	}
+	q.start(st, t)
+	return false, nil
+}
+
+// accepted records that t has been accepted. The caller must hold st.
+func (st *queueState) accepted(t *task) {
+	t.ctx = submittedContext(t.ctx)
+	st.seq++
+	t.seq = st.seq
+	t.gen = st.gen
+	if c := st.hooks.collector; c != nil {
+		c.IncSubmitted()
+	}
+}
+
+// units returns the number of slots t occupies while running.
+func (t *task) units() int {
+	if t.weight < 1 {
+		return 1
+	}
+	return t.weight
+}
+
+// fits reports whether t may start in the free slots of st. A task may
+// always start in an otherwise idle Queue, even if the limit has been
+// lowered below its weight. The caller must hold st.
+func (st *queueState) fits(t *task) bool {
+	if st.fenced || st.alone {
+		return false
+	}
+	if t.exclusive {
+		return st.active == 0
+	}
+	limit := st.maxActive
+	if t.priority == PriorityHigh {
+		limit = st.limit()
+	}
+	return st.active == 0 || st.active+t.units() <= limit
+}
+
+// limit returns the number of slots st may occupy in all: the hard limit
+// set by WithHardLimit, if it is above maxActive, and maxActive otherwise.
+// The caller must hold st.
+func (st *queueState) limit() int {
+	return max(st.maxActive, st.hard)
+}
+
+// start occupies t's slots and runs t in a new goroutine. The caller must
+// hold st.
+func (q *Queue) start(st *queueState, t *task) {
+	st.active += t.units()
+	now := q.clock.Now()
+	st.begin(t, now)
+	j := job{t: t, h: st.hooks, wait: st.reserve(now)}
+	if st.pool != nil {
+		select {
+		case st.pool <- j:
+			return
+		default:
+			// Every pooled worker is busy, which can happen if the
+			// limit has been raised since the pool was created.
+		}
+	}
+	go q.run(j.t, j.h, j.wait)
+}
+
+// startPool starts st's pooled workers. The caller must hold st.
+func (q *Queue) startPool(st *queueState) {
+	st.pool = make(chan job)
+	for i := 0; i < st.workers; i++ {
+		go q.work(st.pool)
+	}
+}
+
+// stopPool makes st's pooled workers, if any, exit once they finish their
+// current job. The caller must hold st.
+func (st *queueState) stopPool() {
+	if st.pool != nil {
+		close(st.pool)
+		st.pool = nil
+	}
+}
+
+// work runs the jobs handed to a pooled worker until pool is closed.
+func (q *Queue) work(pool <-chan job) {
+	for j := range pool {
+		q.run(j.t, j.h, j.wait)
+	}
+}
+
+// mustQueue reports whether t would have to wait in the backlog rather
+// than start at once. The caller must hold st.
+func (st *queueState) mustQueue(t *task) bool {
+	return st.paused || st.backlog.len() > 0 || len(st.fences) > 0 || !st.fits(t)
+}
+
+// isRunning reports whether t is one of st's running tasks. The caller
+// must hold st.
+func (st *queueState) isRunning(t *task) bool {
+	for r := st.running; r != nil; r = r.nextRun {
+		if r == t {
+			return true
+		}
+	}
+	return false
+}
+
+// begin records t as running from now. The caller must hold st.
+func (st *queueState) begin(t *task, now time.Time) {
+	st.alone = t.exclusive
+	t.run = st.deriveRun(t.ctx)
+	var wait time.Duration
+	if !t.since.IsZero() {
+		wait = now.Sub(t.since)
+	}
+	t.since = now
+	st.observeWait(wait)
+	if c := st.hooks.collector; c != nil {
+		c.ObserveWait(wait)
+	}
+	t.nextRun = st.running
+	if st.running != nil {
+		st.running.prevRun = t
+	}
+	st.running = t
+}
+
+// runContext is a cancelable context derived from a submitted context for
+// the tasks that run with it. Consecutive tasks submitted with the same
+// context share one runContext, which is cancelled once none of them is
+// running, so that the Queue does not allocate a new context per task.
+type runContext struct {
+	parent context.Context
+	ctx    context.Context
+	cancel context.CancelFunc
+	refs   int
+}
+
+// deriveRun returns a runContext for a task submitted with ctx, reusing
+// the most recently derived one if it has the same parent. The caller
+// must hold st.
+func (st *queueState) deriveRun(ctx context.Context) *runContext {
+	if rc := st.shared; rc != nil && sameContext(rc.parent, ctx) && rc.ctx.Err() == nil {
+		rc.refs++
+		return rc
+	}
+	rc := &runContext{parent: ctx, refs: 1}
+	rc.ctx, rc.cancel = context.WithCancel(ctx)
+	st.shared = rc
+	return rc
+}
+
+// releaseRun drops a task's reference to rc, cancelling rc once it is no
+// longer used, and reports whether it did so. The caller must hold st.
+func (st *queueState) releaseRun(rc *runContext) bool {
+	if rc.refs--; rc.refs > 0 {
+		return false
+	}
+	if st.shared == rc {
+		st.shared = nil
+	}
+	rc.cancel()
+	return true
+}
+
+// sameContext reports whether a and b are the same context, without
+// panicking on context types that are not comparable.
+func sameContext(a, b context.Context) bool {
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	return ta == tb && ta.Comparable() && a == b
+}
+
+// waitWeight is the weight, as a divisor, given to each new sample in the
+// moving average reported by AvgWaitTime.
+const waitWeight = 16
+
+// observeWait adds d to the moving average of wait times. The caller must
+// hold st.
+func (st *queueState) observeWait(d time.Duration) {
+	if !st.waited {
+		st.avgWait, st.waited = d, true
+		return
+	}
+	st.avgWait += (d - st.avgWait) / waitWeight
+}
+
+// end records that t is no longer running, and reports whether this
+// cancelled the context t ran with. The caller must hold st.
+func (st *queueState) end(t *task) bool {
+	if t.prevRun != nil {
+		t.prevRun.nextRun = t.nextRun
+	} else {
+		st.running = t.nextRun
+	}
+	if t.nextRun != nil {
+		t.nextRun.prevRun = t.prevRun
+	}
+	t.prevRun, t.nextRun = nil, nil
+	return st.releaseRun(t.run)
+}
+
+// run executes t after waiting for its rate-limit reservation, and then
+// continues with backlogged tasks until the backlog is empty, at which
+// point it releases its slot.
+func (q *Queue) run(t *task, h hooks, wait time.Duration) {
+	for {
+		ran := q.await(t, wait)
+		if ran {
+			q.exec(t, h)
+		}
+
+		st := <-q.st
+		now := q.clock.Now()
+		var released context.Context
+		if st.end(t) && h.contextDone != nil {
+			released = t.run.ctx
+			if ran {
+				released = &t.idCtx
+			}
+		}
+		st.release(t)
+		var wake []*Queue
+		if st.budget != nil {
+			wake = st.budget.release(t.units())
+		}
+		if t.barrier {
+			st.fenced = false
+			st.unfence()
+		}
+		if t.exclusive {
+			st.alone = false
+		}
+		if ran {
+			st.completed++
+			st.throughput.add(now)
+			if st.completions != nil {
+				select {
+				case st.completions <- struct{}{}:
+				default:
+				}
+			}
+		}
+		h = st.hooks
+		// If the limit was lowered while t ran, the next task may not
+		// fit, in which case this goroutine gives up its slots.
+		t = st.next()
+		if t == nil {
+			st.signalIdle()
+			q.st <- st
+			q.wake(wake)
+			if released != nil {
+				h.contextDone(released)
+			}
+			return
+		}
+		st.active += t.units()
+		st.begin(t, now)
+		wait = st.reserve(now)
+		// t may have occupied fewer slots than it freed.
+		q.fill(&st)
+		q.st <- st
+		q.wake(wake)
+		if released != nil {
+			h.contextDone(released)
+		}
+	}
+}
+
+// acquire takes t's share of st's shared Limiter, if any, and reports
+// whether it could. The caller must hold st, and must start t if acquire
+// returns true.
+func (st *queueState) acquire(t *task) bool {
+	return st.budget == nil || st.budget.acquire(st.owner, t.units())
+}
+
+// budgetFits reports whether st's shared Limiter, if any, has room for t,
+// without taking any of it. The caller must hold st.
+func (st *queueState) budgetFits(t *task) bool {
+	return st.budget == nil || st.budget.fits(t.units())
+}
+
+// wake kicks the Queues other than q that a shared Limiter refused. The
+// caller must not hold any Queue's state.
+func (q *Queue) wake(queues []*Queue) {
+	for _, w := range queues {
+		if w != q {
+			w.kick()
+		}
+	}
+}
+
+// release frees the slots t occupied. The caller must hold st.
+//
+// A count below zero would mean slots were freed twice, after which the
+// Queue could exceed its limit, so release panics rather than carry on.
+// Like a negative sync.WaitGroup counter, this can only be a bug.
+func (st *queueState) release(t *task) {
+	st.active -= t.units()
+	if st.active < 0 {
+		panic(fmt.Sprintf("goqueue: active count underflow (%d)", st.active))
+	}
+}
+
+// isIdle reports whether st has no running functions, no backlogged
+// functions, and no functions still waiting out an AddAfter delay or
+// waiting for their key.
+func (st *queueState) isIdle() bool {
+	return st.active == 0 && st.delayed == 0 && st.backlog.len() == 0 && st.parked == 0 &&
+		len(st.fences) == 0
+}
+
+// signalIdle closes st's idle channel if st is idle and the channel is
+// not already closed. It also stops the pooled workers of an idle Queue
+// that has been closed or drained, which starts no function until Reset.
+func (st *queueState) signalIdle() {
+	if !st.isIdle() {
+		return
+	}
+	if st.closed || st.draining {
+		st.stopPool()
+	}
+	if st.idle == nil {
+		return
+	}
+	select {
+	case <-st.idle:
+	default:
+		close(st.idle)
+	}
+}
+
+// fill starts backlogged tasks until the backlog is empty or the
+// concurrency limit is reached. The caller must hold st.
+func (q *Queue) fill(st *queueState) {
+	for st.active < st.limit() {
+		t := st.next()
+		if t == nil {
+			return
+		}
+		q.start(st, t)
+	}
+}
+
+// reserve returns how long the next function to start must wait in its
+// slot, as of now: for the rate limiter, if any, plus any start jitter.
+// The caller must hold st.
+func (st *queueState) reserve(now time.Time) time.Duration {
+	var d time.Duration
+	if st.limiter != nil {
+		d = st.limiter.reserve(now)
+	}
+	if st.jitter > 0 {
+		d += rand.N(st.jitter)
+	}
+	return d
+}
+
+// await waits for d to elapse before t may start. It reports false,
+// discarding t, if t's context is done first.
+func (q *Queue) await(t *task, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := q.clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return true
+	case <-t.run.ctx.Done():
+		t.drop(t.run.ctx.Err())
+		return false
+	}
+}
+
+// exec calls t's function between the start and completion hooks,
+// recovering from and reporting any panic so that the caller can go on to
+// release its slot.
+func (q *Queue) exec(t *task, h hooks) {
+	runCtx := t.run.ctx
+	if h.enrich != nil {
+		// Enrich beneath the task context, so that f's context is still
+		// recognised by submittedContext and Yield.
+		runCtx = h.enrich(runCtx, t.attempt())
+	}
+	t.idCtx = taskContext{Context: runCtx, t: t, q: q}
+	ctx := &t.idCtx
+	if h.logger != nil {
+		h.logger.Debugf("goqueue: task %d started", t.seq)
+	}
+	if h.onStart != nil {
+		h.onStart(ctx)
+	}
+	if h.onComplete != nil || h.collector != nil || h.runs != nil || h.logger != nil {
+		start := q.clock.Now()
+		defer func() {
+			elapsed := q.clock.Now().Sub(start)
+			if h.logger != nil {
+				h.logger.Debugf("goqueue: task %d completed in %v", t.seq, elapsed)
+			}
+			if h.onComplete != nil {
+				h.onComplete(ctx, elapsed)
+			}
+			if h.collector != nil {
+				h.collector.ObserveRun(elapsed)
+				h.collector.IncCompleted()
+			}
+			if h.runs != nil {
+				h.runs.observe(elapsed)
+			}
+		}()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			if h.logger != nil {
+				h.logger.Warnf("goqueue: task %d panicked: %v", t.seq, r)
+			}
+			if h.panicHandler != nil {
+				h.panicHandler(r, debug.Stack())
+			}
+		}
+	}()
+	t.f(ctx)
+}
+
+// taskIDKey is the context key for the ID carried by a taskContext.
+type taskIDKey struct{}
+
+// taskKey is the context key for a taskContext itself.
+type taskKey struct{}
+
+// taskContext is the context a task's function is called with. It
+// carries the task's ID, like the result of context.WithValue but without
+// allocating, and the task and Queue for AddWait and Yield.
+type taskContext struct {
+	context.Context
+	t *task
+	q *Queue
+}
+
+func (c *taskContext) Value(key any) any {
+	switch key {
+	case taskIDKey{}:
+		return c.t.seq
+	case taskKey{}:
+		return c
+	}
+	return c.Context.Value(key)
+}
+
+// submittedContext returns the context to submit a function with when the
+// caller passed ctx. A running function's context is cancelled when it
+// returns, so work it submits with that context is submitted with the
+// context the running function was itself submitted with instead, and is
+// not discarded once its submitter returns.
+func submittedContext(ctx context.Context) context.Context {
+	if tc, ok := ctx.(*taskContext); ok {
+		return tc.t.ctx
+	}
+	return ctx
+}
+
+// TaskIDFromContext returns the ID of the task whose function, start hook
+// or completion hook was called with ctx. The ID is the sequence number
+// assigned when the function was accepted, as returned by AddSeq. The
+// boolean result reports whether ctx carries an ID.
+func TaskIDFromContext(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(taskIDKey{}).(int64)
+	return id, ok
+}
+
+// Yield lets a long-running function give up its slot to backlogged work.
+// It submits cont, which should carry on the caller's work, to the back of
+// the backlog of the Queue that is running the caller, with the caller's
+// priority and weight, and exclusive if the caller was submitted by
+// AddExclusive; the caller should then return. Functions that were already
+// waiting run before cont, and cont is run with a context derived from the
+// one the caller was submitted with. If nothing is waiting and a
+// slot is free, cont starts at once.
+//
+// cont is a new submission: it counts towards any submission quota and
+// has its own task ID. Yield returns ErrNotRunning if ctx is neither the
+// context of a function running on a Queue nor derived from one, and
+// otherwise returns the error, if any, with which the Queue rejected cont,
+// as Enqueue does.
+func Yield(ctx context.Context, cont func(context.Context)) error {
+	if cont == nil {
+		panic(nilFunc)
+	}
+	tc, ok := ctx.Value(taskKey{}).(*taskContext)
+	if !ok {
+		return ErrNotRunning
+	}
+	_, err := tc.q.add(&task{ctx: tc.t.ctx, f: cont, priority: tc.t.priority, weight: tc.t.weight, exclusive: tc.t.exclusive})
+	return err
+}
+
+// next removes and returns the next backlogged task to run, or nil if
+// the backlog is empty or the next task does not fit in the free slots.
+// Tasks whose context is already done are discarded without running.
+func (st *queueState) next() *task {
+	st.checkRoot()
+	if st.paused {
+		return nil
+	}
+	for {
+		t := st.backlog.peekReady()
+		if t == nil {
+			// Everything submitted before the oldest barrier has
+			// been started; it runs once that has all finished.
+			if len(st.fences) == 0 || st.active > 0 {
+				return nil
+			}
+			t = st.fences[0]
+			err := expired(t.ctx)
+			if err == nil && !st.acquire(t) {
+				return nil
+			}
+			st.fences = st.fences[1:]
+			if err != nil {
+				st.unfence()
+				continue
+			}
+			st.fenced = true
+			return t
+		}
+		if err := expired(t.ctx); err != nil {
+			st.backlog.remove(t)
+			t.drop(err)
+			if h := st.hooks.dropped; h != nil {
+				go h(t.ctx)
+			}
+			continue
+		}
+		if !st.fits(t) || !st.acquire(t) {
+			return nil
+		}
+		st.backlog.remove(t)
+		t.markStarted()
+		return t
+	}
+}
+
+// Barrier submits f to run once every function submitted before it has
+// finished, with no other function running at the same time. Functions
+// submitted after Barrier, at any priority, do not start until f has
+// returned. This makes f a checkpoint between phases of work, for
+// example to flush buffers written by the functions before it.
+//
+// Functions submitted before Barrier but still waiting out an AddAfter
+// delay, or waiting for their key in AddKeyed, count as submitted when
+// they reach the backlog. If ctx is done before f starts, f is discarded
+// and the functions after it may start. Like Add, Barrier discards f if
+// the Queue is draining or closed.
+func (q *Queue) Barrier(ctx context.Context, f func(context.Context)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	st := <-q.st
+	defer func() { q.st <- st }()
+	if st.rejecting() != nil {
+		return
+	}
+	if q.maxSubmissions >= 0 && st.seq >= q.maxSubmissions {
+		return
+	}
+	t := &task{ctx: ctx, f: f, barrier: true}
+	st.accepted(t)
+	st.gen++
+	if st.isIdle() {
+		// Mark q as non-idle
+		st.idle = nil
+	}
+	st.fences = append(st.fences, t)
+	q.fill(&st)
+}
+
+// unfence lets the backlogged functions submitted before the oldest
+// pending barrier, or all of them if there is none, start. The caller must
+// hold st.
+func (st *queueState) unfence() {
+	gen := st.gen
+	if len(st.fences) > 0 {
+		gen = st.fences[0].gen
+	}
+	st.backlog.release(gen)
+}
+
+// dropFences discards the barriers that have not yet started. The caller
+// must hold st.
+func (st *queueState) dropFences() {
+	if len(st.fences) == 0 {
+		return
+	}
+	clear(st.fences)
+	st.fences = nil
+	if !st.fenced {
+		st.unfence()
+	}
+}
+
+// expired returns ctx.Err(), or context.DeadlineExceeded if ctx's deadline
+// has passed but ctx has not yet noticed.
+func expired(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d, ok := ctx.Deadline(); ok && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// Idle returns a channel that is closed when the Queue becomes idle.
+//
+// The returned channel is closed when there are no active functions running,
+// the backlog is empty and no function submitted with AddAfter is still
+// waiting out its delay. If the Queue is already idle at the time of the
+// call, the returned channel is already closed.
+//
+// Multiple calls to Idle may return the same channel while the Queue
+// remains non-idle.
+//
+// A Queue created by NewQueueWithContext also counts as idle once its
+// context is done, even if functions are still running.
+func (q *Queue) Idle() <-chan struct{} {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	st.checkRoot()
+	if st.idle == nil {
+		st.idle = make(chan struct{})
+		if st.isIdle() {
+			close(st.idle)
+		}
+	}
+	return st.idle
+}
+
+// IsIdle reports whether the Queue is idle, in the sense of Idle: no
+// function is running, the backlog is empty and no function submitted
+// with AddAfter is waiting out its delay, or the Queue has been
+// terminated by the context of NewQueueWithContext. Unlike Idle, IsIdle
+// does not allocate.
+func (q *Queue) IsIdle() bool {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	st.checkRoot()
+	return st.terminated || st.isIdle()
+}
+
+// SetErrorHandler sets the function called with errors returned by
+// functions submitted with AddErr. A nil h discards such errors.
+func (q *Queue) SetErrorHandler(h ErrorHandler) {
+	st := <-q.st
+	st.errorHandler = h
+	q.st <- st
+}
+
+// Close marks the Queue as closed. Every subsequent submission is
+// rejected with ErrClosed and the Queue cannot be reused.
+//
+// Close does not cancel or wait for work that was already accepted:
+// active functions run to completion and the backlog continues to be
+// processed. To also wait for that work, call Drain after Close.
+//
+// Close returns nil the first time it is called and ErrClosed thereafter.
+func (q *Queue) Close() error {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	if st.closed {
+		return ErrClosed
+	}
+	st.closed = true
+	st.signalIdle()
+	return nil
+}
+
+// Cancel discards every function waiting in the backlog without running
+// it. Active functions are not affected and run to completion; the Queue
+// becomes idle, and Idle's channel is closed, once they have finished.
+// Functions submitted with AddAfter that are still waiting out their
+// delay are not discarded: they are submitted once it elapses, and the
+// Queue is not idle until they too have finished. Shutdown discards them.
+//
+// Cancel does not close the Queue, which continues to accept new
+// functions.
+func (q *Queue) Cancel() {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	st.clearBacklog()
+	st.dropParked()
+	st.dropFences()
+	st.signalIdle()
+}
+
+// ClearBacklog discards every function waiting in the backlog without
+// running it, as Cancel does, and returns how many it discarded: the
+// number BacklogLen would have reported. Unlike Cancel, it leaves
+// functions waiting for their key in AddKeyed, and functions submitted by
+// Barrier, in place.
+//
+// Active functions are not affected, and the Queue continues to accept
+// new functions; it becomes idle once the functions it is still running
+// or holding have finished.
+func (q *Queue) ClearBacklog() int64 {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	n := st.clearBacklog()
+	st.signalIdle()
+	return n
+}
+
+// clearBacklog discards st's backlog, reporting ErrCanceled to each
+// task's dropped callback, and returns the number of tasks discarded. The
+// caller must hold st.
+func (st *queueState) clearBacklog() int64 {
+	var n int64
+	for t := st.backlog.pop(); t != nil; t = st.backlog.pop() {
+		n++
+		t.drop(ErrCanceled)
+	}
+	return n
+}
+
+// Wait blocks until the Queue is idle, as reported by Idle, or until ctx
+// is done.
+//
+// Wait returns nil if the Queue became idle and ctx.Err() otherwise.
+func (q *Queue) Wait(ctx context.Context) error {
+	select {
+	case <-q.Idle():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IdleCtx is equivalent to Wait: it returns nil once the Queue is idle,
+// or ctx.Err() if ctx is done first. It is provided for callers that
+// think of the wait in terms of Idle.
+func (q *Queue) IdleCtx(ctx context.Context) error {
+	return q.Wait(ctx)
+}
+
+// WaitTimeout blocks until the Queue is idle or until d has elapsed. It
+// reports whether the Queue became idle.
+func (q *Queue) WaitTimeout(d time.Duration) bool {
+	timer := q.clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-q.Idle():
+		return true
+	case <-timer.C():
+		return false
+	}
+}
+
+// SetPanicHandler sets the function called when a function run by q
+// panics. A nil h discards recovered panics.
+//
+// Panics are always recovered, so a panicking function does not prevent
+// the Queue from processing the rest of its backlog.
+func (q *Queue) SetPanicHandler(h PanicHandler) {
+	st := <-q.st
+	st.hooks.panicHandler = h
+	q.st <- st
+}
+
+// SetOnStart sets a function called with a function's context
+// immediately before the Queue runs it, including functions started from
+// the backlog. A nil h removes the hook.
+//
+// The hook runs on the function's goroutine while it occupies its slot.
+func (q *Queue) SetOnStart(h func(ctx context.Context)) {
+	st := <-q.st
+	st.hooks.onStart = h
+	q.st <- st
+}
+
+// SetOnComplete sets a function called with a function's context and
+// running time immediately after it returns or panics. A nil h removes
+// the hook.
+//
+// The hook runs on the function's goroutine while it occupies its slot.
+func (q *Queue) SetOnComplete(h func(ctx context.Context, elapsed time.Duration)) {
+	st := <-q.st
+	st.hooks.onComplete = h
+	q.st <- st
+}
+
+// SetMaxActive changes the maximum number of functions that may run
+// concurrently.
+//
+// If n is larger than the current limit, backlogged functions are started
+// immediately to fill the new slots. If n is smaller, running functions
+// are not interrupted, but no further functions are started until the
+// number running drops below n.
+//
+// n must be greater than zero and, if the Queue was created with
+// WithMaxActiveCeiling, no greater than the ceiling. Otherwise
+// SetMaxActive returns an error and leaves the limit unchanged.
+func (q *Queue) SetMaxActive(n int) error {
+	if n < 1 {
+		return fmt.Errorf("goQueue called with nonpositive limit (%d)", n)
+	}
+
+	st := <-q.st
+	if st.ceiling > 0 && n > st.ceiling {
+		q.st <- st
+		return fmt.Errorf("goQueue called with limit %d above ceiling %d", n, st.ceiling)
+	}
+	st.maxActive = n
+	q.fill(&st)
+	st.signalIdle()
+	q.st <- st
+	return nil
+}
+
+// MaxActive returns the current maximum number of functions that may run
+// concurrently, as set by the constructor or SetMaxActive.
+func (q *Queue) MaxActive() int {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	return st.maxActive
+}
+
+// Reset prepares an idle Queue for reuse with the same configuration. It
+// resets the counters reported by Completed, RecentThroughput, AddSeq,
+// AvgWaitTime, RunDurationHistogram and Stats, restores the quota set by
+// WithMaxSubmissions, and reopens a Queue that was drained or closed, so
+// that it accepts functions again.
+//
+// Reset returns ErrBusy, changing nothing, if the Queue is not idle in
+// the sense of Idle. It returns ErrClosed if the Queue has been shut down,
+// which is permanent.
+func (q *Queue) Reset() error {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	if st.shutdown {
+		return ErrClosed
+	}
+	if !st.isIdle() {
+		return ErrBusy
+	}
+	st.completed = 0
+	*st.throughput = throughputRing{}
+	if st.hooks.runs != nil {
+		st.hooks.runs.reset()
+	}
+	st.seq = 0
+	st.avgWait, st.waited = 0, false
+	st.draining = false
+	st.closed = false
+	if st.workers > 0 && st.pool == nil {
+		q.startPool(&st)
+	}
+	return nil
+}
+
+// Pause stops the Queue from starting functions. Functions already running
+// continue, and new submissions are accepted into the backlog as usual,
+// but none is started until Resume is called. A paused Queue with a
+// non-empty backlog is not idle.
+func (q *Queue) Pause() {
+	st := <-q.st
+	st.paused = true
+	q.st <- st
+}
+
+// Resume undoes Pause, starting backlogged functions up to the
+// concurrency limit.
+func (q *Queue) Resume() {
+	st := <-q.st
+	st.paused = false
+	q.fill(&st)
+	st.signalIdle()
+	q.st <- st
+}
+
+// Shutdown stops the Queue from accepting new functions, discards the
+// backlog, and waits for the active functions to return.
+//
+// Unlike Drain, Shutdown does not run backlogged functions, or functions
+// submitted with AddAfter that are still waiting out their delay. Those
+// are discarded at once, without waiting for their delays. Shutdown
+// returns nil once the active functions have returned, or ctx.Err() if
+// ctx is done first, in which case the active functions are left running.
+// Use ShutdownForce to cancel them instead.
+//
+// After Shutdown, every submission is rejected with ErrClosed. It is safe
+// to call Shutdown more than once.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	return q.shutdownWait(ctx, false)
+}
+
+// ShutdownForce is like Shutdown, but if ctx is done before the active
+// functions return, the contexts passed to them are cancelled. It returns
+// ctx.Err() in that case, without waiting for the functions to observe
+// the cancellation.
+func (q *Queue) ShutdownForce(ctx context.Context) error {
+	return q.shutdownWait(ctx, true)
+}
+
+// ShutdownGraceful is like Shutdown, but gives the active functions only
+// grace to return by themselves. Once it has elapsed, the contexts passed
+// to the functions still running are cancelled, and ShutdownGraceful
+// waits for those functions to return. It then returns a *ShutdownError
+// with the number it cancelled, or nil if there were none. If ctx is done
+// first, ShutdownGraceful returns ctx.Err() at once, and functions already
+// cancelled are left to return in their own time.
+func (q *Queue) ShutdownGraceful(ctx context.Context, grace time.Duration) error {
+	q.stop()
+	idle := q.Idle()
+	timer := q.clock.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C():
+	}
+
+	st := <-q.st
+	n := 0
+	for t := st.running; t != nil; t = t.nextRun {
+		t.run.cancel()
+		n++
+	}
+	q.st <- st
+	if err := q.Wait(ctx); err != nil {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	return &ShutdownError{Cancelled: n}
+}
+
+func (q *Queue) shutdownWait(ctx context.Context, force bool) error {
+	q.stop()
+	err := q.Wait(ctx)
+	if err != nil && force {
+		st := <-q.st
+		for t := st.running; t != nil; t = t.nextRun {
+			t.run.cancel()
+		}
+		q.st <- st
+	}
+	return err
+}
+
+// ShutdownNow is like Shutdown, but returns without waiting for the active
+// functions, which are allowed to finish. It returns the payloads of the
+// discarded backlogged functions, as PendingPayloads would have reported
+// them: in the order in which they would have started, with nil for each
+// function not submitted by AddPayload. Functions submitted with AddAfter
+// that are still waiting out their delay are discarded but not reported.
+func (q *Queue) ShutdownNow() []any {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	return st.abandon()
+}
+
+// DrainWithProgress is like Drain, but while it waits it calls progress
+// every interval with the number of functions still to finish: those
+// running, those in the backlog, and those that keep the Queue from being
+// idle without being backlogged, such as functions waiting out an
+// AddAfter delay or for their key in AddKeyed, and barriers that have not
+// started. A function submitted by AddWeighted counts once, whatever its
+// weight. progress is called on the calling goroutine, and no further
+// calls are made once DrainWithProgress returns.
+func (q *Queue) DrainWithProgress(ctx context.Context, interval time.Duration, progress func(remaining int64)) error {
+	st := <-q.st
+	st.draining = true
+	st.signalIdle()
+	q.st <- st
+
+	idle := q.Idle()
+	for {
+		timer := q.clock.NewTimer(interval)
+		select {
+		case <-idle:
+			timer.Stop()
+			return nil
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C():
+			st := <-q.st
+			remaining := st.remaining()
+			q.st <- st
+			progress(remaining)
+		}
+	}
+}
+
+// remaining returns the number of functions st has still to finish, as
+// reported by DrainWithProgress. The caller must hold st.
+func (st *queueState) remaining() int64 {
+	n := st.backlog.len() + st.parked + st.delayed + len(st.fences)
+	for t := st.running; t != nil; t = t.nextRun {
+		n++
+	}
+	return int64(n)
+}
+
+// stop closes q and discards its backlog, as the first step of Shutdown.
+func (q *Queue) stop() {
+	st := <-q.st
+	st.abandon()
+	q.st <- st
+}
+
+// abandon closes st and discards its backlog, returning the payloads of
+// the discarded tasks in the order they would have started. The caller
+// must hold st.
+func (st *queueState) abandon() []any {
+	if !st.shutdown {
+		close(st.halt)
+		st.delayed = 0
+	}
+	st.closed = true
+	st.shutdown = true
+	// No task can be started from now on.
+	st.stopPool()
+	var payloads []any
+	for t := st.backlog.pop(); t != nil; t = st.backlog.pop() {
+		payloads = append(payloads, t.payload())
+		t.drop(ErrCanceled)
+	}
+	st.dropParked()
+	st.dropFences()
+	st.signalIdle()
+	return payloads
+}
+
+// checkRoot terminates st if the context it was created with is done, so
+// that cancellation takes effect as soon as the state is next used,
+// without waiting for context.AfterFunc. The caller must hold st.
+func (st *queueState) checkRoot() {
+	if st.root == nil || st.terminated || st.root.Err() == nil {
+		return
+	}
+	st.abandon()
+	st.terminated = true
+	if st.idle == nil {
+		st.idle = make(chan struct{})
+	}
+	select {
+	case <-st.idle:
+	default:
+		close(st.idle)
+	}
+}
+
+// Drain stops the Queue from accepting new functions and waits until all
+// active and backlogged functions have completed.
+//
+// Drain returns nil once the Queue is idle, or ctx.Err() if ctx is done
+// first; in either case the Queue continues to process the work it had
+// already accepted. After Drain has been called, every subsequent
+// submission is rejected with ErrDraining and the Queue cannot be reused.
+// It is safe to call Drain more than once, including concurrently.
+func (q *Queue) Drain(ctx context.Context) error {
+	st := <-q.st
+	st.draining = true
+	st.signalIdle()
+	q.st <- st
+
+	return q.Wait(ctx)
+}
+
+// BacklogLen returns the number of functions currently waiting in the backlog.
+//
+// This does not include functions that are actively running.
+func (q *Queue) BacklogLen() int64 {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	return int64(st.backlog.len())
+}
+
+// PeekLabels returns the labels of the backlogged functions, in the order
+// in which they would start. Functions submitted without a label, by any
+// method other than AddLabeled, are reported with an empty label.
+func (q *Queue) PeekLabels() []string {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	labels := make([]string, 0, st.backlog.len())
+	st.backlog.each(func(t *task) { labels = append(labels, t.label()) })
+	return labels
+}
+
+// CancelGroup removes every backlogged function submitted by AddLabeled
+// with label, so that none of them runs, and returns how many it removed.
+// Functions with the label that are already running are not affected.
+func (q *Queue) CancelGroup(label string) int {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	if label == "" {
+		return 0
+	}
+	ts := st.backlog.labeled(label)
+	for _, t := range ts {
+		st.backlog.remove(t)
+		t.drop(ErrCanceled)
+	}
+	st.signalIdle()
+	return len(ts)
+}
+
+// PendingPayloads returns the payloads of the backlogged functions, in
+// the order in which they would start. Functions submitted by any method
+// other than AddPayload are reported with a nil payload.
+//
+// Together with AddPayload, this lets a caller persist the work that has
+// not yet started and resubmit it later, for example after a restart.
+func (q *Queue) PendingPayloads() []any {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	payloads := make([]any, 0, st.backlog.len())
+	st.backlog.each(func(t *task) { payloads = append(payloads, t.payload()) })
+	return payloads
+}
+
+// BacklogEvents returns a channel that receives the new backlog length
+// each time it changes.
+//
+// The channel is buffered and coalescing: if the receiver falls behind,
+// intermediate lengths are dropped and only the most recent is delivered,
+// so a slow receiver never blocks the Queue. Every call returns the same
+// channel, which is never closed; it is intended for a single receiver.
+func (q *Queue) BacklogEvents() <-chan int64 {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	if st.backlog.events == nil {
+		st.backlog.events = make(chan int64, 1)
+	}
+	return st.backlog.events
+}
+
+// RunDurationHistogram returns the number of functions whose running time
+// fell in each bucket of the histogram configured by
+// WithRunDurationBuckets, keyed by the bucket's bound. Functions that ran
+// longer than every bound are counted under the key math.MaxInt64. Every
+// bucket is present, even if empty, so approximate percentiles can be read
+// off by summing the counts in order of bound.
+//
+// RunDurationHistogram returns nil if the Queue keeps no histogram.
+func (q *Queue) RunDurationHistogram() map[time.Duration]uint64 {
+	st := <-q.st
+	h := st.hooks.runs
+	q.st <- st
+	if h == nil {
+		return nil
+	}
+	return h.snapshot()
+}
+
+// WaitBacklogBelow blocks until fewer than n functions are waiting in the
+// backlog, or until ctx is done, in which case it returns ctx.Err(). It
+// returns at once if the backlog is already shorter than n.
+//
+// Since the backlog length is never negative, WaitBacklogBelow with n <= 0
+// can only return ctx.Err(), once ctx is done.
+//
+// A producer can call WaitBacklogBelow before each Add to hold the backlog
+// near n. Other producers may submit work between WaitBacklogBelow
+// returning and the caller's Add, so n is not a hard limit; use
+// WithMaxBacklog for that.
+func (q *Queue) WaitBacklogBelow(ctx context.Context, n int64) error {
+	if n <= 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	for {
+		st := <-q.st
+		if int64(st.backlog.len()) < n {
+			q.st <- st
+			return nil
+		}
+		if st.backlog.shrunk == nil {
+			st.backlog.shrunk = make(chan struct{})
+		}
+		shrunk := st.backlog.shrunk
+		q.st <- st
+
+		select {
+		case <-shrunk:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// completionsBuffer is the capacity of the channel returned by
+// Completions.
+const completionsBuffer = 64
+
+// Completions returns a channel that receives a value each time a function
+// finishes running, including functions that panicked. Functions
+// discarded without running are not reported, so the values received
+// match the increase in Completed.
+//
+// The channel has room for 64 values. A completion that finds it full is
+// dropped rather than blocking the Queue, so a receiver that falls more
+// than 64 completions behind undercounts; use Completed for an exact
+// count. Every call returns the same channel, which is never closed; it is
+// intended for a single receiver.
+func (q *Queue) Completions() <-chan struct{} {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	if st.completions == nil {
+		st.completions = make(chan struct{}, completionsBuffer)
+	}
+	return st.completions
+}
+
+// ActiveCount returns the number of functions currently running, with a
+// function submitted by AddWeighted counted as its weight.
+//
+// This does not include functions waiting in the backlog.
+func (q *Queue) ActiveCount() int64 {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	return int64(st.active)
+}
+
+// Completed returns the number of functions q has finished running over
+// its lifetime, including functions that panicked. Functions discarded
+// from the backlog without running are not counted.
+func (q *Queue) Completed() int64 {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	return st.completed
+}
+
+// RecentThroughput returns the number of functions q finished running per
+// second over the trailing window, counting them as Completed does. It
+// returns 0 if window is not positive.
+//
+// Completions are counted in one-second buckets, of which the last 60 are
+// kept, so memory use does not grow with throughput. The price is
+// resolution: window is capped at one minute, and the buckets at either
+// end of it are counted whole, including the current, partial second. The
+// result can therefore be off by up to a second's worth of completions,
+// which matters less the longer the window; windows of a few seconds or
+// more are reasonable for load-based decisions.
+func (q *Queue) RecentThroughput(window time.Duration) float64 {
+	if window <= 0 {
+		return 0
+	}
+	window = min(window, throughputBuckets*time.Second)
+	now := q.clock.Now()
+	st := <-q.st
+	defer func() { q.st <- st }()
+	return st.throughput.rate(now, window)
+}
+
+// AvgWaitTime returns a moving average of the time functions have spent in
+// the backlog before starting. Functions that started immediately count as
+// zero wait. It returns 0 if no function has started yet.
+//
+// The average is exponentially weighted, each newly started function
+// contributing 1/16 of the result, so it tracks recent behavior rather
+// than the Queue's whole lifetime.
+func (q *Queue) AvgWaitTime() time.Duration {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	return st.avgWait
+}
+
+// Utilization returns the fraction of the concurrency limit in use, from
+// 0 when no function is running to 1 when every slot is occupied. It is
+// computed from a single consistent snapshot. While running functions
+// exceed a recently lowered limit, Utilization reports 1.
+func (q *Queue) Utilization() float64 {
+	st := <-q.st
+	active, maxActive := st.active, st.maxActive
+	q.st <- st
+	if active >= maxActive {
+		return 1
+	}
+	return float64(active) / float64(maxActive)
+}
+
+// OldestActiveAge returns how long the longest-running active function
+// has been running, measured from when it was given a slot, or zero if no
+// function is running. An unexpectedly large value suggests a function is
+// stuck.
+func (q *Queue) OldestActiveAge() time.Duration {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	return st.oldestActiveAge(q.clock.Now())
+}
+
+// oldestActiveAge returns how long st's longest-running function has been
+// running as of now, or zero if none is. The caller must hold st.
+func (st *queueState) oldestActiveAge(now time.Time) time.Duration {
+	// Tasks are linked into the running list as they begin, so the
+	// oldest is last.
+	var oldest *task
+	for t := st.running; t != nil; t = t.nextRun {
+		oldest = t
+	}
+	if oldest == nil {
+		return 0
+	}
+	return now.Sub(oldest.since)
+}
+
+// Healthy reports whether q looks healthy, for a liveness probe: it
+// returns false if more than maxBacklog functions are backlogged, as
+// reported by BacklogLen, or if a function has been running for longer
+// than maxOldestAge, as reported by OldestActiveAge, which suggests it is
+// stuck. Both are read from the same snapshot of q's state.
+func (q *Queue) Healthy(maxBacklog int64, maxOldestAge time.Duration) bool {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	return int64(st.backlog.len()) <= maxBacklog &&
+		st.oldestActiveAge(q.clock.Now()) <= maxOldestAge
+}
+
+// An ActiveTask describes a function that was running when ActiveSnapshot
+// was called.
+type ActiveTask struct {
+	Seq     int64     // sequence number, as returned by AddSeq
+	Label   string    // label given to AddLabeled; empty otherwise
+	Started time.Time // when the function was given a slot
+}
+
+// ActiveSnapshot returns a description of each running function, oldest
+// first. As for ActiveCount, a function counts as running from when it is
+// given a slot, including any wait for the rate limiter. The result is a
+// copy that the caller may keep and modify.
+func (q *Queue) ActiveSnapshot() []ActiveTask {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	var active []ActiveTask
+	for t := st.running; t != nil; t = t.nextRun {
+		active = append(active, ActiveTask{Seq: t.seq, Label: t.label(), Started: t.since})
+	}
+	// The running list is newest first.
+	slices.Reverse(active)
+	return active
+}
+
+// Stats is a point-in-time snapshot of a Queue's state.
+type Stats struct {
+	Active         int64 // functions currently running
+	Backlog        int64 // functions waiting in the backlog
+	MaxActive      int64 // current concurrency limit
+	TotalCompleted int64 // functions that have finished running
+}
+
+// Stats returns a consistent snapshot of q's counters, all read under a
+// single acquisition of the Queue's state.
+func (q *Queue) Stats() Stats {
+	st := <-q.st
+	defer func() { q.st <- st }()
+	return Stats{
+		Active:         int64(st.active),
+		Backlog:        int64(st.backlog.len()),
+		MaxActive:      int64(st.maxActive),
+		TotalCompleted: st.completed,
+	}
 }
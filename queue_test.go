@@ -2,8 +2,11 @@ package goqueue
 
 import (
 	"context"
+	"errors"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -118,3 +121,2334 @@ func TestNewQueue(t *testing.T) {
 		t.Errorf("expected error for non-positive queue length")
 	}
 }
+
+func TestQueueAddWait(t *testing.T) {
+	const (
+		maxActive = 2
+		callers   = 10
+	)
+
+	q, _ := NewQueue(maxActive)
+	var (
+		mu      sync.Mutex
+		running int
+		wg      sync.WaitGroup
+	)
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			err := q.AddWait(context.Background(), func(context.Context) {
+				mu.Lock()
+				running++
+				if running > maxActive {
+					t.Errorf("%d functions running, want at most %d", running, maxActive)
+				}
+				mu.Unlock()
+				time.Sleep(10 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+			})
+			if err != nil {
+				t.Errorf("AddWait returned %v, want nil", err)
+			}
+		}()
+	}
+	wg.Wait()
+	<-q.Idle()
+}
+
+func TestQueueAddWaitCancel(t *testing.T) {
+	q, _ := NewQueue(1)
+	unblock := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { <-unblock })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		errc <- q.AddWait(ctx, func(context.Context) {
+			t.Errorf("function run after AddWait was cancelled")
+		})
+	}()
+	for q.BacklogLen() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("AddWait returned %v, want %v", err, context.Canceled)
+	}
+	if l := q.BacklogLen(); l != 0 {
+		t.Errorf("backlog len after cancelled AddWait = %d, want 0", l)
+	}
+	close(unblock)
+	<-q.Idle()
+
+	// A context that is already done is refused even with a slot free.
+	if err := q.AddWait(ctx, func(context.Context) {
+		t.Errorf("function run with an already cancelled context")
+	}); err != context.Canceled {
+		t.Errorf("AddWait with a cancelled context returned %v, want %v", err, context.Canceled)
+	}
+	<-q.Idle()
+}
+
+func TestBoundedQueue(t *testing.T) {
+	q, _ := NewBoundedQueue(1, 1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+
+	for i, want := range []error{nil, nil, ErrBacklogFull} {
+		if err := q.Enqueue(ctx, func(context.Context) { <-unblock }); err != want {
+			t.Errorf("Enqueue #%d returned %v, want %v", i, err, want)
+		}
+	}
+	if l := q.BacklogLen(); l != 1 {
+		t.Errorf("backlog len = %d, want 1", l)
+	}
+	close(unblock)
+	<-q.Idle()
+}
+
+func TestBoundedQueueNoBacklog(t *testing.T) {
+	q, _ := NewBoundedQueue(1, 0)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+
+	if err := q.Enqueue(ctx, func(context.Context) { <-unblock }); err != nil {
+		t.Errorf("Enqueue with free slot returned %v, want nil", err)
+	}
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != ErrBacklogFull {
+		t.Errorf("Enqueue with no free slot returned %v, want %v", err, ErrBacklogFull)
+	}
+	close(unblock)
+	<-q.Idle()
+}
+
+func TestQueueSkipsCancelledBacklog(t *testing.T) {
+	q, _ := NewQueue(1)
+	unblock := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { <-unblock })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.Add(ctx, func(context.Context) {
+		t.Errorf("backlogged function run after its context was cancelled")
+	})
+	ran := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { close(ran) })
+
+	cancel()
+	close(unblock)
+	<-ran
+	<-q.Idle()
+}
+
+func TestQueueDrain(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	var done int
+	for i := 0; i < 3; i++ {
+		q.Add(ctx, func(context.Context) {
+			time.Sleep(10 * time.Millisecond)
+			done++
+		})
+	}
+
+	if err := q.Drain(ctx); err != nil {
+		t.Fatalf("Drain returned %v, want nil", err)
+	}
+	if done != 3 {
+		t.Errorf("%d functions completed before Drain returned, want 3", done)
+	}
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != ErrDraining {
+		t.Errorf("Enqueue after Drain returned %v, want %v", err, ErrDraining)
+	}
+	if err := q.Drain(ctx); err != nil {
+		t.Errorf("second Drain returned %v, want nil", err)
+	}
+}
+
+func TestQueueDrainTimeout(t *testing.T) {
+	q, _ := NewQueue(1)
+	unblock := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { <-unblock })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Drain(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Drain returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(unblock)
+	<-q.Idle()
+}
+
+func TestQueuePanicRecovery(t *testing.T) {
+	q, _ := NewQueue(1)
+	recovered := make(chan any, 1)
+	q.SetPanicHandler(func(r any, stack []byte) {
+		if len(stack) == 0 {
+			t.Errorf("PanicHandler called with empty stack")
+		}
+		recovered <- r
+	})
+
+	ctx := context.Background()
+	q.Add(ctx, func(context.Context) { panic("boom") })
+	ran := make(chan struct{})
+	q.Add(ctx, func(context.Context) { close(ran) })
+
+	<-ran
+	<-q.Idle()
+	if r := <-recovered; r != "boom" {
+		t.Errorf("PanicHandler recovered %v, want %q", r, "boom")
+	}
+}
+
+func TestQueueActiveCount(t *testing.T) {
+	q, _ := NewQueue(2)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	started := make(chan struct{}, 3)
+	for i := 0; i < 3; i++ {
+		q.Add(ctx, func(context.Context) {
+			started <- struct{}{}
+			<-unblock
+		})
+	}
+	<-started
+	<-started
+
+	if n := q.ActiveCount(); n != 2 {
+		t.Errorf("active count = %d, want 2", n)
+	}
+	close(unblock)
+	<-q.Idle()
+	if n := q.ActiveCount(); n != 0 {
+		t.Errorf("active count when idle = %d, want 0", n)
+	}
+}
+
+func TestQueueSetMaxActive(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	started := make(chan struct{}, 4)
+	for i := 0; i < 4; i++ {
+		q.Add(ctx, func(context.Context) {
+			started <- struct{}{}
+			<-unblock
+		})
+	}
+	<-started
+
+	if err := q.SetMaxActive(3); err != nil {
+		t.Fatalf("SetMaxActive(3) returned %v", err)
+	}
+	<-started
+	<-started
+	if n := q.ActiveCount(); n != 3 {
+		t.Errorf("active count after raising limit = %d, want 3", n)
+	}
+
+	if err := q.SetMaxActive(1); err != nil {
+		t.Fatalf("SetMaxActive(1) returned %v", err)
+	}
+	if n := q.ActiveCount(); n != 3 {
+		t.Errorf("active count after lowering limit = %d, want 3", n)
+	}
+	if err := q.SetMaxActive(0); err == nil {
+		t.Errorf("SetMaxActive(0) returned nil error")
+	}
+
+	close(unblock)
+	<-started
+	<-q.Idle()
+}
+
+func TestQueueAddWithTimeout(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	q.Add(ctx, func(context.Context) { time.Sleep(50 * time.Millisecond) })
+
+	errc := make(chan error, 1)
+	q.AddWithTimeout(ctx, 20*time.Millisecond, func(ctx context.Context) {
+		if err := ctx.Err(); err != nil {
+			t.Errorf("context done at start: %v", err)
+		}
+		<-ctx.Done()
+		errc <- ctx.Err()
+	})
+	<-q.Idle()
+	if err := <-errc; err != context.DeadlineExceeded {
+		t.Errorf("context error = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestQueueAddWithTimeoutClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	q, _ := NewQueueWithOptions(1, WithClock(clock))
+	started := make(chan struct{})
+	errc := make(chan error, 1)
+	q.AddWithTimeout(context.Background(), time.Minute, func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		errc <- ctx.Err()
+	})
+	<-started
+	for clock.waiting() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.advance(59 * time.Second)
+	select {
+	case err := <-errc:
+		t.Fatalf("context done before the timeout: %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	clock.advance(time.Second)
+	if err := <-errc; err != context.DeadlineExceeded {
+		t.Errorf("context error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	<-q.Idle()
+}
+
+func TestQueuePriority(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+
+	var order []string
+	submit := func(p Priority, name string) {
+		q.AddPriority(ctx, p, func(context.Context) { order = append(order, name) })
+	}
+	submit(PriorityLow, "low1")
+	submit(PriorityNormal, "normal1")
+	submit(PriorityHigh, "high1")
+	submit(PriorityLow, "low2")
+	submit(PriorityHigh, "high2")
+	submit(PriorityNormal, "normal2")
+
+	close(unblock)
+	<-q.Idle()
+	want := []string{"high1", "high2", "normal1", "normal2", "low1", "low2"}
+	if strings.Join(order, " ") != strings.Join(want, " ") {
+		t.Errorf("execution order = %v, want %v", order, want)
+	}
+}
+
+func TestQueueWait(t *testing.T) {
+	q, _ := NewQueue(1)
+	if err := q.Wait(context.Background()); err != nil {
+		t.Errorf("Wait on idle queue returned %v, want nil", err)
+	}
+
+	unblock := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { <-unblock })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Wait on busy queue returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(unblock)
+	if err := q.Wait(context.Background()); err != nil {
+		t.Errorf("Wait returned %v, want nil", err)
+	}
+}
+
+func TestQueueAddErr(t *testing.T) {
+	q, _ := NewQueue(2)
+	var (
+		mu   sync.Mutex
+		errs []error
+	)
+	q.SetErrorHandler(func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	})
+
+	ctx := context.Background()
+	errBoom := errors.New("boom")
+	q.AddErr(ctx, func(context.Context) error { return errBoom })
+	q.AddErr(ctx, func(context.Context) error { return nil })
+	<-q.Idle()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(errs) != 1 || errs[0] != errBoom {
+		t.Errorf("ErrorHandler received %v, want [%v]", errs, errBoom)
+	}
+}
+
+func TestQueueClose(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	ran := make(chan struct{})
+	q.Add(ctx, func(context.Context) { time.Sleep(10 * time.Millisecond) })
+	q.Add(ctx, func(context.Context) { close(ran) })
+
+	if err := q.Close(); err != nil {
+		t.Errorf("Close returned %v, want nil", err)
+	}
+	if err := q.Close(); err != ErrClosed {
+		t.Errorf("second Close returned %v, want %v", err, ErrClosed)
+	}
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != ErrClosed {
+		t.Errorf("Enqueue after Close returned %v, want %v", err, ErrClosed)
+	}
+	<-ran // Backlogged work accepted before Close still runs.
+	<-q.Idle()
+}
+
+func TestQueueAddAll(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+
+	var order []int
+	fs := make([]func(context.Context), 5)
+	for i := range fs {
+		fs[i] = func(context.Context) { order = append(order, i) }
+	}
+	q.AddAll(ctx, fs)
+	if l := q.BacklogLen(); l != int64(len(fs)) {
+		t.Errorf("backlog len = %d, want %d", l, len(fs))
+	}
+
+	close(unblock)
+	<-q.Idle()
+	for i, v := range order {
+		if i != v {
+			t.Fatalf("execution order = %v, want submission order", order)
+		}
+	}
+}
+
+func BenchmarkGoQueueWorkerPool(b *testing.B) {
+	q, _ := NewQueueWithOptions(10, WithWorkerPool(true))
+
+	for i := 0; i < 1_000_000; i++ {
+		q.Add(context.Background(), func(ctx context.Context) {
+			s := "new string"
+			strings.Join([]string{s}, "new")
+		})
+	}
+
+	<-q.Idle()
+}
+
+func BenchmarkGoQueueAddAll(b *testing.B) {
+	q, _ := NewQueue(10)
+
+	fs := make([]func(context.Context), 1_000_000)
+	for i := range fs {
+		fs[i] = func(ctx context.Context) {
+			s := "new string"
+			strings.Join([]string{s}, "new")
+		}
+	}
+	q.AddAll(context.Background(), fs)
+
+	<-q.Idle()
+}
+
+func TestQueueTryAdd(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+
+	if !q.TryAdd(ctx, func(context.Context) { <-unblock }) {
+		t.Errorf("TryAdd on idle queue reported not started")
+	}
+	if q.TryAdd(ctx, func(context.Context) {}) {
+		t.Errorf("TryAdd on full queue reported started")
+	}
+	close(unblock)
+	<-q.Idle()
+}
+
+func TestQueueLifecycleHooks(t *testing.T) {
+	q, _ := NewQueue(1)
+	var (
+		mu         sync.Mutex
+		events     []string
+		minElapsed = time.Duration(-1)
+	)
+	q.SetOnStart(func(context.Context) {
+		mu.Lock()
+		events = append(events, "start")
+		mu.Unlock()
+	})
+	q.SetOnComplete(func(_ context.Context, elapsed time.Duration) {
+		mu.Lock()
+		events = append(events, "complete")
+		if minElapsed < 0 || elapsed < minElapsed {
+			minElapsed = elapsed
+		}
+		mu.Unlock()
+	})
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		q.Add(ctx, func(context.Context) { time.Sleep(5 * time.Millisecond) })
+	}
+	<-q.Idle()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := strings.Join(events, " "), "start complete start complete"; got != want {
+		t.Errorf("hook events = %q, want %q", got, want)
+	}
+	if minElapsed < 5*time.Millisecond {
+		t.Errorf("OnComplete elapsed = %v, want at least 5ms", minElapsed)
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	q, _ := NewQueue(2)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	started := make(chan struct{}, 3)
+	for i := 0; i < 3; i++ {
+		q.Add(ctx, func(context.Context) {
+			started <- struct{}{}
+			<-unblock
+		})
+	}
+	<-started
+	<-started
+
+	want := Stats{Active: 2, Backlog: 1, MaxActive: 2}
+	if s := q.Stats(); s != want {
+		t.Errorf("Stats() = %+v, want %+v", s, want)
+	}
+	close(unblock)
+	<-q.Idle()
+	want = Stats{MaxActive: 2, TotalCompleted: 3}
+	if s := q.Stats(); s != want {
+		t.Errorf("Stats() when idle = %+v, want %+v", s, want)
+	}
+}
+
+func TestQueueCompleted(t *testing.T) {
+	const (
+		workers = 8
+		perWork = 100
+	)
+	q, _ := NewQueue(4)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWork; j++ {
+				q.Add(context.Background(), func(context.Context) {})
+			}
+		}()
+	}
+	wg.Wait()
+	<-q.Idle()
+
+	if n := q.Completed(); n != workers*perWork {
+		t.Errorf("Completed() = %d, want %d", n, workers*perWork)
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	for i := 0; i < 3; i++ {
+		q.Add(ctx, func(context.Context) {
+			t.Errorf("cancelled function was run")
+		})
+	}
+	errc := make(chan error)
+	go func() { errc <- q.AddWait(ctx, func(context.Context) {}) }()
+	for q.BacklogLen() != 4 {
+		time.Sleep(time.Millisecond)
+	}
+
+	q.Cancel()
+	if l := q.BacklogLen(); l != 0 {
+		t.Errorf("backlog len after Cancel = %d, want 0", l)
+	}
+	if err := <-errc; err != ErrCanceled {
+		t.Errorf("AddWait returned %v, want %v", err, ErrCanceled)
+	}
+	idle := q.Idle()
+	select {
+	case <-idle:
+		t.Errorf("queue idle while a function is still running")
+	default:
+	}
+	close(unblock)
+	<-idle
+
+	ran := make(chan struct{})
+	q.Add(ctx, func(context.Context) { close(ran) })
+	<-ran
+}
+
+func TestQueueFIFOUnderChurn(t *testing.T) {
+	const (
+		rounds = 20
+		n      = 2000
+	)
+	for r := 0; r < rounds; r++ {
+		q, _ := NewQueue(1)
+		ctx := context.Background()
+		order := make([]int, 0, n)
+		for i := 0; i < n; i++ {
+			q.Add(ctx, func(context.Context) { order = append(order, i) })
+			if i%97 == 0 {
+				// Let the queue drain now and then so that submissions
+				// alternate between starting immediately and backlogging.
+				<-q.Idle()
+			}
+		}
+		<-q.Idle()
+
+		for i, v := range order {
+			if i != v {
+				t.Fatalf("round %d: function %d ran at position %d", r, v, i)
+			}
+		}
+		if len(order) != n {
+			t.Fatalf("round %d: %d functions ran, want %d", r, len(order), n)
+		}
+	}
+}
+
+func TestQueueWaitTimeout(t *testing.T) {
+	q, _ := NewQueue(1)
+	unblock := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { <-unblock })
+
+	if q.WaitTimeout(10 * time.Millisecond) {
+		t.Errorf("WaitTimeout on busy queue reported idle")
+	}
+	close(unblock)
+	if !q.WaitTimeout(time.Second) {
+		t.Errorf("WaitTimeout did not report idle after work finished")
+	}
+}
+
+func TestQueueAddAfter(t *testing.T) {
+	q, _ := NewQueue(1)
+	const delay = 20 * time.Millisecond
+	start := time.Now()
+	ran := make(chan time.Time, 1)
+	q.AddAfter(context.Background(), delay, func(context.Context) { ran <- time.Now() })
+
+	if n := q.BacklogLen(); n != 0 {
+		t.Errorf("backlog len while delayed = %d, want 0", n)
+	}
+	select {
+	case <-q.Idle():
+		t.Errorf("queue idle while a delayed function is pending")
+	default:
+	}
+	<-q.Idle()
+	if d := (<-ran).Sub(start); d < delay {
+		t.Errorf("delayed function ran after %v, want at least %v", d, delay)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q.AddAfter(ctx, time.Hour, func(context.Context) {
+		t.Errorf("delayed function run after its context was cancelled")
+	})
+	cancel()
+	<-q.Idle()
+}
+
+func TestQueueIdleCycle(t *testing.T) {
+	q, _ := NewQueue(1)
+	for cycle := 0; cycle < 3; cycle++ {
+		select {
+		case <-q.Idle():
+		default:
+			t.Fatalf("cycle %d: queue not idle before work was added", cycle)
+		}
+
+		unblock := make(chan struct{})
+		q.Add(context.Background(), func(context.Context) { <-unblock })
+		idle := q.Idle()
+		select {
+		case <-idle:
+			t.Fatalf("cycle %d: Idle returned a closed channel while busy", cycle)
+		default:
+		}
+		close(unblock)
+		<-idle
+	}
+}
+
+func TestQueueAddCancelable(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	started := make(chan struct{})
+	unblock := make(chan struct{})
+	running := q.AddCancelable(ctx, func(context.Context) {
+		close(started)
+		<-unblock
+	})
+	waiting := q.AddCancelable(ctx, func(context.Context) {
+		t.Errorf("cancelled function was run")
+	})
+	<-started
+
+	if running.Cancel() {
+		t.Errorf("Cancel of running function reported success")
+	}
+	if !waiting.Cancel() {
+		t.Errorf("Cancel of backlogged function reported failure")
+	}
+	if waiting.Cancel() {
+		t.Errorf("second Cancel reported success")
+	}
+	if l := q.BacklogLen(); l != 0 {
+		t.Errorf("backlog len after Cancel = %d, want 0", l)
+	}
+	close(unblock)
+	<-q.Idle()
+}
+
+func TestQueueAddUnique(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	var runs int
+	refresh := func(context.Context) { runs++ }
+
+	if !q.AddUnique(ctx, "a", func(context.Context) { <-unblock }) {
+		t.Errorf("AddUnique of running key reported not enqueued")
+	}
+	if !q.AddUnique(ctx, "a", refresh) {
+		t.Errorf("AddUnique with only a running duplicate reported not enqueued")
+	}
+	if q.AddUnique(ctx, "a", refresh) {
+		t.Errorf("AddUnique with a backlogged duplicate reported enqueued")
+	}
+	if !q.AddUnique(ctx, "b", refresh) {
+		t.Errorf("AddUnique of new key reported not enqueued")
+	}
+	close(unblock)
+	<-q.Idle()
+	if runs != 2 {
+		t.Errorf("%d unique functions ran, want 2", runs)
+	}
+
+	if !q.AddUnique(ctx, "a", refresh) {
+		t.Errorf("AddUnique after key left the backlog reported not enqueued")
+	}
+	<-q.Idle()
+}
+
+func TestQueueBacklogEvents(t *testing.T) {
+	q, _ := NewQueue(1)
+	events := q.BacklogEvents()
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+
+	q.Add(ctx, func(context.Context) {})
+	if n := <-events; n != 1 {
+		t.Errorf("backlog event = %d, want 1", n)
+	}
+	q.Add(ctx, func(context.Context) {})
+	q.Add(ctx, func(context.Context) {})
+	if n := <-events; n != 3 {
+		t.Errorf("coalesced backlog event = %d, want 3", n)
+	}
+
+	close(unblock)
+	<-q.Idle()
+	if n := <-events; n != 0 {
+		t.Errorf("backlog event after draining = %d, want 0", n)
+	}
+}
+
+func TestQueueShutdown(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	q.Add(ctx, func(context.Context) {
+		close(started)
+		time.Sleep(10 * time.Millisecond)
+		close(finished)
+	})
+	q.Add(ctx, func(context.Context) {
+		t.Errorf("backlogged function run after Shutdown")
+	})
+	<-started
+
+	if err := q.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown returned %v, want nil", err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Errorf("Shutdown returned before the active function finished")
+	}
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != ErrClosed {
+		t.Errorf("Enqueue after Shutdown returned %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestQueueShutdownDelayed(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		shutdown func(*Queue) error
+	}{
+		{"Shutdown", func(q *Queue) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			return q.Shutdown(ctx)
+		}},
+		{"ShutdownGraceful", func(q *Queue) error {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			return q.ShutdownGraceful(ctx, time.Second)
+		}},
+		{"ShutdownNow", func(q *Queue) error {
+			q.ShutdownNow()
+			return nil
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q, _ := NewQueue(1)
+			q.AddAfter(context.Background(), time.Hour, func(context.Context) {
+				t.Errorf("delayed function ran after shutdown")
+			})
+			if err := tc.shutdown(q); err != nil {
+				t.Fatalf("%s with a pending AddAfter returned %v, want nil", tc.name, err)
+			}
+			if !q.IsIdle() {
+				t.Errorf("queue is not idle after %s with a pending AddAfter", tc.name)
+			}
+		})
+	}
+}
+
+func TestQueueShutdownForce(t *testing.T) {
+	q, _ := NewQueue(1)
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	q.Add(context.Background(), func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+	})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.ShutdownForce(ctx); err != context.DeadlineExceeded {
+		t.Errorf("ShutdownForce returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	<-cancelled
+	<-q.Idle()
+}
+
+func TestQueueShutdownGraceful(t *testing.T) {
+	q, _ := NewQueue(3)
+	ctx := context.Background()
+	var started sync.WaitGroup
+	started.Add(3)
+	stubborn := func(ctx context.Context) {
+		started.Done()
+		<-ctx.Done()
+	}
+	q.Add(ctx, stubborn)
+	q.Add(ctx, stubborn)
+	q.Add(ctx, func(context.Context) { started.Done() })
+	started.Wait()
+
+	err := q.ShutdownGraceful(ctx, 10*time.Millisecond)
+	var se *ShutdownError
+	if !errors.As(err, &se) || se.Cancelled != 2 {
+		t.Errorf("ShutdownGraceful returned %v, want a ShutdownError for 2 functions", err)
+	}
+	if n := q.ActiveCount(); n != 0 {
+		t.Errorf("ActiveCount after ShutdownGraceful = %d, want 0", n)
+	}
+
+	// Functions that finish within the grace period are not cancelled.
+	q, _ = NewQueue(1)
+	q.Add(ctx, func(context.Context) { time.Sleep(time.Millisecond) })
+	if err := q.ShutdownGraceful(ctx, time.Minute); err != nil {
+		t.Errorf("ShutdownGraceful returned %v, want nil", err)
+	}
+}
+
+func TestQueueAddSeq(t *testing.T) {
+	q, _ := NewQueue(2)
+	ctx := context.Background()
+	var (
+		mu   sync.Mutex
+		seen = make(map[int64]bool)
+		wg   sync.WaitGroup
+	)
+	wg.Add(4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			defer wg.Done()
+			last := int64(0)
+			for j := 0; j < 50; j++ {
+				seq := q.AddSeq(ctx, func(context.Context) {})
+				if seq <= last {
+					t.Errorf("AddSeq returned %d after %d", seq, last)
+				}
+				last = seq
+				mu.Lock()
+				if seen[seq] {
+					t.Errorf("AddSeq returned duplicate %d", seq)
+				}
+				seen[seq] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	<-q.Idle()
+	for seq := int64(1); seq <= 200; seq++ {
+		if !seen[seq] {
+			t.Errorf("sequence number %d was never returned", seq)
+		}
+	}
+
+	q.Close()
+	if seq := q.AddSeq(ctx, func(context.Context) {}); seq != 0 {
+		t.Errorf("AddSeq on closed queue returned %d, want 0", seq)
+	}
+}
+
+func TestQueueAddDone(t *testing.T) {
+	q, _ := NewQueue(1)
+	unblock := make(chan struct{})
+	first := q.AddDone(context.Background(), func(context.Context) { <-unblock })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	skipped := q.AddDone(ctx, func(context.Context) {
+		t.Errorf("function run after its context was cancelled")
+	})
+	select {
+	case <-first:
+		t.Errorf("done channel closed before the function finished")
+	default:
+	}
+
+	cancel()
+	close(unblock)
+	<-first
+	<-skipped
+
+	q.Close()
+	<-q.AddDone(context.Background(), func(context.Context) {})
+}
+
+func TestQueueIdleManyWaiters(t *testing.T) {
+	const waiters = 100
+	q, _ := NewQueue(2)
+	unblock := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		q.Add(context.Background(), func(context.Context) { <-unblock })
+	}
+
+	var (
+		ready sync.WaitGroup
+		done  sync.WaitGroup
+	)
+	ready.Add(waiters)
+	done.Add(waiters)
+	for i := 0; i < waiters; i++ {
+		go func() {
+			defer done.Done()
+			idle := q.Idle()
+			ready.Done()
+			<-idle
+		}()
+	}
+	ready.Wait()
+	close(unblock)
+	done.Wait()
+}
+
+func TestQueueAvgWaitTime(t *testing.T) {
+	q, _ := NewQueue(1)
+	if d := q.AvgWaitTime(); d != 0 {
+		t.Errorf("AvgWaitTime before any work = %v, want 0", d)
+	}
+
+	ctx := context.Background()
+	q.Add(ctx, func(context.Context) { time.Sleep(20 * time.Millisecond) })
+	<-q.Idle()
+	if d := q.AvgWaitTime(); d != 0 {
+		t.Errorf("AvgWaitTime with no backlog = %v, want 0", d)
+	}
+
+	q.Add(ctx, func(context.Context) { time.Sleep(20 * time.Millisecond) })
+	q.Add(ctx, func(context.Context) {})
+	<-q.Idle()
+	if d := q.AvgWaitTime(); d <= 0 || d > 20*time.Millisecond {
+		t.Errorf("AvgWaitTime = %v, want in (0, 20ms]", d)
+	}
+}
+
+func TestTaskIDFromContext(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	if _, ok := TaskIDFromContext(ctx); ok {
+		t.Errorf("TaskIDFromContext reported an ID for a plain context")
+	}
+
+	ids := make(chan int64, 2)
+	record := func(ctx context.Context) {
+		id, ok := TaskIDFromContext(ctx)
+		if !ok {
+			t.Errorf("TaskIDFromContext reported no ID")
+		}
+		ids <- id
+	}
+	unblock := make(chan struct{})
+	// The first function runs immediately, the second is promoted from
+	// the backlog.
+	first := q.AddSeq(ctx, func(ctx context.Context) {
+		record(ctx)
+		<-unblock
+	})
+	second := q.AddSeq(ctx, record)
+	close(unblock)
+	<-q.Idle()
+
+	for _, want := range []int64{first, second} {
+		if got := <-ids; got != want {
+			t.Errorf("TaskIDFromContext = %d, want %d", got, want)
+		}
+	}
+}
+
+func TestQueueAddRetry(t *testing.T) {
+	errc := make(chan error, 2)
+	q, _ := NewQueueWithOptions(1, WithErrorHandler(func(err error) { errc <- err }))
+	ctx := context.Background()
+
+	var backoffs []int
+	backoff := func(attempt int) time.Duration {
+		backoffs = append(backoffs, attempt)
+		return time.Millisecond
+	}
+
+	calls := 0
+	q.AddRetry(ctx, func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	}, 5, backoff)
+	<-q.Idle()
+	if calls != 3 {
+		t.Errorf("succeeding function called %d times, want 3", calls)
+	}
+	if len(backoffs) != 2 || backoffs[0] != 1 || backoffs[1] != 2 {
+		t.Errorf("backoff called with %v, want [1 2]", backoffs)
+	}
+
+	calls = 0
+	errs := []error{errors.New("first"), errors.New("second"), errors.New("third")}
+	q.AddRetry(ctx, func(context.Context) error {
+		calls++
+		return errs[calls-1]
+	}, 3, nil)
+	<-q.Idle()
+	if calls != 3 {
+		t.Errorf("failing function called %d times, want 3", calls)
+	}
+	select {
+	case err := <-errc:
+		if err != errs[2] {
+			t.Errorf("ErrorHandler received %v, want %v", err, errs[2])
+		}
+	default:
+		t.Errorf("ErrorHandler was not called")
+	}
+	select {
+	case err := <-errc:
+		t.Errorf("ErrorHandler called again with %v", err)
+	default:
+	}
+}
+
+func TestQueuePeekLabels(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.AddLabeled(ctx, "running", func(context.Context) { <-unblock })
+
+	canceled, cancel := context.WithCancel(ctx)
+	q.AddLabeled(ctx, "a", func(context.Context) {})
+	h := q.AddCancelable(ctx, func(context.Context) {})
+	q.AddLabeled(canceled, "b", func(context.Context) {})
+	q.AddPriority(ctx, PriorityHigh, func(context.Context) {})
+	q.AddLabeled(ctx, "c", func(context.Context) {})
+
+	check := func(want ...string) {
+		t.Helper()
+		if got := q.PeekLabels(); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("PeekLabels = %q, want %q", got, want)
+		}
+	}
+	check("", "a", "", "b", "c")
+	h.Cancel()
+	check("", "a", "b", "c")
+
+	cancel()
+	close(unblock)
+	<-q.Idle()
+	check()
+}
+
+func TestNewQueueWithContext(t *testing.T) {
+	if _, err := NewQueueWithContext(context.Background(), 0); err == nil {
+		t.Errorf("expected error for non-positive queue length")
+	}
+
+	before := runtime.NumGoroutine()
+	root, cancel := context.WithCancel(context.Background())
+	q, _ := NewQueueWithContext(root, 4)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		q.Add(ctx, func(context.Context) { <-unblock })
+	}
+	ran := make(chan struct{}, 100)
+	for i := 0; i < 100; i++ {
+		q.Add(ctx, func(context.Context) { ran <- struct{}{} })
+	}
+
+	cancel()
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != ErrClosed {
+		t.Errorf("Enqueue after cancellation returned %v, want %v", err, ErrClosed)
+	}
+	close(unblock)
+	<-q.Idle()
+	if n := len(ran); n != 0 {
+		t.Errorf("%d backlogged functions ran after cancellation", n)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines running after the queue wound down, want at most %d", n, before)
+	}
+}
+
+func TestQueueIsIdle(t *testing.T) {
+	q, _ := NewQueue(1)
+	if !q.IsIdle() {
+		t.Errorf("new queue is not idle")
+	}
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	q.Add(ctx, func(context.Context) {})
+	if q.IsIdle() {
+		t.Errorf("busy queue reported idle")
+	}
+	close(unblock)
+	<-q.Idle()
+	if !q.IsIdle() {
+		t.Errorf("queue is not idle after Idle fired")
+	}
+}
+
+func TestQueueContextPropagation(t *testing.T) {
+	type key struct{}
+	q, _ := NewQueue(1)
+
+	for _, name := range []string{"first", "second"} {
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, name))
+		started := make(chan struct{})
+		stopped := make(chan struct{})
+		q.Add(ctx, func(ctx context.Context) {
+			if v := ctx.Value(key{}); v != name {
+				t.Errorf("%s function saw value %v, want %q", name, v, name)
+			}
+			close(started)
+			<-ctx.Done()
+			if err := ctx.Err(); err != context.Canceled {
+				t.Errorf("%s function saw %v, want %v", name, err, context.Canceled)
+			}
+			close(stopped)
+		})
+		<-started
+		cancel()
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatalf("cancellation did not reach the %s function", name)
+		}
+	}
+
+	// A function that waited in the backlog gets the same guarantees.
+	unblock := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { <-unblock })
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "waited"))
+	defer cancel()
+	done := make(chan struct{})
+	q.Add(ctx, func(ctx context.Context) {
+		if v := ctx.Value(key{}); v != "waited" {
+			t.Errorf("function promoted from the backlog saw value %v", v)
+		}
+		cancel()
+		if ctx.Err() == nil {
+			t.Errorf("cancellation did not reach the function promoted from the backlog")
+		}
+		close(done)
+	})
+	close(unblock)
+	<-done
+	<-q.Idle()
+}
+
+func TestQueueSubmitAndWait(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+
+	ran := false
+	if err := q.SubmitAndWait(ctx, func(context.Context) {
+		time.Sleep(10 * time.Millisecond)
+		ran = true
+	}); err != nil {
+		t.Errorf("SubmitAndWait returned %v", err)
+	}
+	if !ran {
+		t.Errorf("SubmitAndWait returned before f finished")
+	}
+
+	if err := q.SubmitAndWait(ctx, func(context.Context) { panic("boom") }); err != nil {
+		t.Errorf("SubmitAndWait of panicking function returned %v", err)
+	}
+
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := q.SubmitAndWait(waitCtx, func(context.Context) {
+		t.Errorf("function ran after its context expired in the backlog")
+	}); err != context.DeadlineExceeded {
+		t.Errorf("SubmitAndWait returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := q.BacklogLen(); n != 0 {
+		t.Errorf("BacklogLen = %d after SubmitAndWait gave up, want 0", n)
+	}
+	close(unblock)
+	<-q.Idle()
+
+	if err := q.SubmitAndWait(waitCtx, func(context.Context) {
+		t.Errorf("function ran with an already expired context")
+	}); err != context.DeadlineExceeded {
+		t.Errorf("SubmitAndWait with an expired context returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	q.Close()
+	if err := q.SubmitAndWait(ctx, func(context.Context) {}); err != ErrClosed {
+		t.Errorf("SubmitAndWait on closed queue returned %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestQueueAddWeighted(t *testing.T) {
+	q, _ := NewQueue(3)
+	ctx := context.Background()
+	if err := q.AddWeighted(ctx, 4, func(context.Context) {}); err != ErrTooHeavy {
+		t.Errorf("AddWeighted over the limit returned %v, want %v", err, ErrTooHeavy)
+	}
+
+	var (
+		mu       sync.Mutex
+		units    int
+		maxUnits int
+		order    []string
+	)
+	job := func(name string, weight int) func(context.Context) {
+		return func(context.Context) {
+			mu.Lock()
+			units += weight
+			if units > maxUnits {
+				maxUnits = units
+			}
+			order = append(order, name)
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			units -= weight
+			mu.Unlock()
+		}
+	}
+
+	q.AddWeighted(ctx, 1, job("light1", 1))
+	q.AddWeighted(ctx, 1, job("light2", 1))
+	q.AddWeighted(ctx, 3, job("heavy", 3))
+	q.AddWeighted(ctx, 1, job("light3", 1))
+	if n := q.ActiveCount(); n != 2 {
+		t.Errorf("ActiveCount = %d, want 2", n)
+	}
+	<-q.Idle()
+
+	if maxUnits > 3 {
+		t.Errorf("%d units ran concurrently, want at most 3", maxUnits)
+	}
+	// light1 and light2 start together, in either order.
+	if len(order) != 4 || order[2] != "heavy" || order[3] != "light3" {
+		t.Errorf("start order = %v, want heavy third and light3 last", order)
+	}
+}
+
+func TestQueuePendingPayloads(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.AddPayload(ctx, "running", func(context.Context) { <-unblock })
+
+	q.AddPayload(ctx, 1, func(context.Context) {})
+	h := q.AddCancelable(ctx, func(context.Context) {})
+	q.AddPayload(ctx, 2, func(context.Context) {})
+	q.AddPriority(ctx, PriorityHigh, func(context.Context) {})
+
+	check := func(want ...any) {
+		t.Helper()
+		got := q.PendingPayloads()
+		if len(got) != len(want) {
+			t.Errorf("PendingPayloads = %v, want %v", got, want)
+			return
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("PendingPayloads = %v, want %v", got, want)
+				return
+			}
+		}
+	}
+	check(nil, 1, nil, 2)
+	h.Cancel()
+	check(nil, 1, 2)
+
+	close(unblock)
+	<-q.Idle()
+	check()
+}
+
+func TestQueueShutdownNow(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	finished := make(chan struct{})
+	q.AddPayload(ctx, "running", func(context.Context) {
+		<-unblock
+		close(finished)
+	})
+	for i := 1; i <= 3; i++ {
+		q.AddPayload(ctx, i, func(context.Context) {
+			t.Errorf("backlogged function ran after ShutdownNow")
+		})
+	}
+	q.Add(ctx, func(context.Context) {})
+
+	undone := q.ShutdownNow()
+	if want := []any{1, 2, 3, nil}; len(undone) != len(want) ||
+		undone[0] != want[0] || undone[1] != want[1] || undone[2] != want[2] || undone[3] != want[3] {
+		t.Errorf("ShutdownNow returned %v, want %v", undone, want)
+	}
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != ErrClosed {
+		t.Errorf("Enqueue after ShutdownNow returned %v, want %v", err, ErrClosed)
+	}
+
+	close(unblock)
+	<-finished
+	<-q.Idle()
+}
+
+func TestQueueIdleCtx(t *testing.T) {
+	q, _ := NewQueue(1)
+	unblock := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { <-unblock })
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.IdleCtx(ctx); err != context.Canceled {
+		t.Errorf("IdleCtx on busy queue returned %v, want %v", err, context.Canceled)
+	}
+	close(unblock)
+	if err := q.IdleCtx(context.Background()); err != nil {
+		t.Errorf("IdleCtx returned %v, want nil", err)
+	}
+}
+
+func TestQueuePauseResume(t *testing.T) {
+	q, _ := NewQueue(2)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	finished := make(chan struct{})
+	q.Add(ctx, func(context.Context) {
+		<-unblock
+		close(finished)
+	})
+
+	q.Pause()
+	var ran int64
+	var mu sync.Mutex
+	for i := 0; i < 3; i++ {
+		q.Add(ctx, func(context.Context) {
+			mu.Lock()
+			ran++
+			mu.Unlock()
+		})
+	}
+	if n := q.BacklogLen(); n != 3 {
+		t.Errorf("BacklogLen while paused = %d, want 3", n)
+	}
+	close(unblock)
+	<-finished
+	if q.WaitTimeout(10 * time.Millisecond) {
+		t.Errorf("paused queue with a backlog became idle")
+	}
+	mu.Lock()
+	if ran != 0 {
+		t.Errorf("%d functions started while paused", ran)
+	}
+	mu.Unlock()
+
+	q.Resume()
+	<-q.Idle()
+	if ran != 3 {
+		t.Errorf("%d functions ran after Resume, want 3", ran)
+	}
+
+	// Canceling the backlog of a paused queue leaves it idle.
+	q.Pause()
+	q.Add(ctx, func(context.Context) { t.Errorf("canceled function ran") })
+	q.Cancel()
+	if !q.WaitTimeout(time.Second) {
+		t.Errorf("paused queue did not become idle after Cancel")
+	}
+	q.Resume()
+}
+
+func TestQueueAddSimple(t *testing.T) {
+	q, _ := NewQueue(1)
+	var order []int
+	for i := 0; i < 3; i++ {
+		q.AddSimple(func() { order = append(order, i) })
+	}
+	<-q.Idle()
+	if len(order) != 3 || order[0] != 0 || order[1] != 1 || order[2] != 2 {
+		t.Errorf("AddSimple ran %v, want [0 1 2]", order)
+	}
+}
+
+func TestQueueMaxActive(t *testing.T) {
+	q, _ := NewQueue(3)
+	if n := q.MaxActive(); n != 3 {
+		t.Errorf("MaxActive = %d, want 3", n)
+	}
+	q.SetMaxActive(5)
+	if n := q.MaxActive(); n != 5 {
+		t.Errorf("MaxActive after SetMaxActive(5) = %d, want 5", n)
+	}
+}
+
+func TestQueueAddWithValues(t *testing.T) {
+	type tenant struct{}
+	type parent struct{}
+	onStart := make(chan any, 2)
+	q, _ := NewQueueWithOptions(1, WithOnStart(func(ctx context.Context) { onStart <- ctx.Value(tenant{}) }))
+	ctx := context.WithValue(context.Background(), parent{}, "p")
+
+	values := map[any]any{tenant{}: "a"}
+	seen := make(chan [2]any, 2)
+	record := func(ctx context.Context) { seen <- [2]any{ctx.Value(tenant{}), ctx.Value(parent{})} }
+	q.AddWithValues(ctx, values, record)
+	values[tenant{}] = "changed"
+	q.Add(ctx, record)
+	<-q.Idle()
+
+	if got := <-seen; got != [2]any{"a", "p"} {
+		t.Errorf("function saw values %v, want [a p]", got)
+	}
+	if got := <-seen; got != [2]any{nil, "p"} {
+		t.Errorf("values leaked to the next function: %v", got)
+	}
+	if v := <-onStart; v != "a" {
+		t.Errorf("start hook saw tenant %v, want a", v)
+	}
+}
+
+func TestQueueAddWaitTimeout(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	if err := q.AddWaitTimeout(ctx, time.Second, func(context.Context) {}); err != nil {
+		t.Errorf("AddWaitTimeout on idle queue returned %v", err)
+	}
+	<-q.Idle()
+
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	if err := q.AddWaitTimeout(ctx, 10*time.Millisecond, func(context.Context) {
+		t.Errorf("function ran after its wait timed out")
+	}); err != ErrWaitTimeout {
+		t.Errorf("AddWaitTimeout on busy queue returned %v, want %v", err, ErrWaitTimeout)
+	}
+	if n := q.BacklogLen(); n != 0 {
+		t.Errorf("BacklogLen = %d after AddWaitTimeout gave up, want 0", n)
+	}
+	close(unblock)
+	<-q.Idle()
+}
+
+func TestQueueDrainWithProgress(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		q.Add(ctx, func(context.Context) { time.Sleep(10 * time.Millisecond) })
+	}
+
+	var reports []int64
+	if err := q.DrainWithProgress(ctx, 5*time.Millisecond, func(remaining int64) {
+		reports = append(reports, remaining)
+	}); err != nil {
+		t.Fatalf("DrainWithProgress returned %v", err)
+	}
+	if len(reports) == 0 {
+		t.Fatalf("progress was never called")
+	}
+	for i, n := range reports {
+		if n < 0 || n > 5 || (i > 0 && n > reports[i-1]) {
+			t.Errorf("progress reports %v are not a non-increasing count of at most 5", reports)
+			break
+		}
+	}
+	if err := q.Enqueue(ctx, func(context.Context) {}); err != ErrDraining {
+		t.Errorf("Enqueue after DrainWithProgress returned %v, want %v", err, ErrDraining)
+	}
+}
+
+func TestQueueDrainWithProgressCounts(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	q, _ := NewQueueWithOptions(4, WithClock(clock))
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.AddWeighted(ctx, 4, func(context.Context) { <-unblock }) // running
+	q.Add(ctx, func(context.Context) {})                       // backlogged
+	q.AddAfter(ctx, time.Hour, func(context.Context) {})       // delayed
+	q.Barrier(ctx, func(context.Context) {})                   // unstarted barrier
+	q.AddKeyed(ctx, "k", func(context.Context) {})             // backlogged
+	q.AddKeyed(ctx, "k", func(context.Context) {})             // parked
+
+	drainCtx, cancel := context.WithCancel(ctx)
+	reports := make(chan int64, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- q.DrainWithProgress(drainCtx, time.Second, func(remaining int64) { reports <- remaining })
+	}()
+	for clock.waiting() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.advance(time.Second)
+	if n := <-reports; n != 6 {
+		t.Errorf("progress reported %d functions remaining, want 6", n)
+	}
+	cancel()
+	<-done
+
+	close(unblock)
+	clock.advance(time.Hour)
+	<-q.Idle()
+}
+
+func TestQueueReset(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	if err := q.Reset(); err != ErrBusy {
+		t.Errorf("Reset on busy queue returned %v, want %v", err, ErrBusy)
+	}
+	close(unblock)
+	if err := q.Drain(ctx); err != nil {
+		t.Fatalf("Drain returned %v", err)
+	}
+
+	if err := q.Reset(); err != nil {
+		t.Fatalf("Reset on drained queue returned %v", err)
+	}
+	if n := q.Completed(); n != 0 {
+		t.Errorf("Completed after Reset = %d, want 0", n)
+	}
+	if seq := q.AddSeq(ctx, func(context.Context) {}); seq != 1 {
+		t.Errorf("AddSeq after Reset = %d, want 1", seq)
+	}
+	<-q.Idle()
+
+	q.Shutdown(ctx)
+	if err := q.Reset(); err != ErrClosed {
+		t.Errorf("Reset after Shutdown returned %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestQueueOldestActiveAge(t *testing.T) {
+	q, _ := NewQueue(2)
+	if d := q.OldestActiveAge(); d != 0 {
+		t.Errorf("OldestActiveAge of idle queue = %v, want 0", d)
+	}
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	time.Sleep(20 * time.Millisecond)
+	q.Add(ctx, func(context.Context) { <-unblock })
+	if d := q.OldestActiveAge(); d < 20*time.Millisecond {
+		t.Errorf("OldestActiveAge = %v, want at least 20ms", d)
+	}
+	close(unblock)
+	<-q.Idle()
+	if d := q.OldestActiveAge(); d != 0 {
+		t.Errorf("OldestActiveAge after Idle = %v, want 0", d)
+	}
+}
+
+func TestQueueHealthy(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	q, _ := NewQueueWithOptions(1, WithClock(clock))
+	if !q.Healthy(0, 0) {
+		t.Errorf("idle queue is not healthy")
+	}
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	q.Add(ctx, func(context.Context) {})
+	clock.advance(time.Minute)
+
+	if !q.Healthy(1, time.Minute) {
+		t.Errorf("queue within both limits is not healthy")
+	}
+	if q.Healthy(0, time.Minute) {
+		t.Errorf("queue with a backlog above maxBacklog is healthy")
+	}
+	if q.Healthy(1, time.Second) {
+		t.Errorf("queue with a function running longer than maxOldestAge is healthy")
+	}
+	close(unblock)
+	<-q.Idle()
+	if !q.Healthy(0, 0) {
+		t.Errorf("queue is not healthy once idle again")
+	}
+}
+
+func TestQueueBarrier(t *testing.T) {
+	q, _ := NewQueue(3)
+	ctx := context.Background()
+	var (
+		mu       sync.Mutex
+		running  int
+		finished int
+		barrier  bool // whether the barrier has finished
+	)
+	work := func(phase int) func(context.Context) {
+		return func(context.Context) {
+			mu.Lock()
+			if phase == 1 && !barrier {
+				t.Errorf("function submitted after the barrier started before it finished")
+			}
+			running++
+			mu.Unlock()
+			time.Sleep(2 * time.Millisecond)
+			mu.Lock()
+			running--
+			finished++
+			mu.Unlock()
+		}
+	}
+
+	for i := 0; i < 7; i++ {
+		q.Add(ctx, work(0))
+	}
+	q.Barrier(ctx, func(context.Context) {
+		mu.Lock()
+		defer mu.Unlock()
+		if finished != 7 || running != 0 {
+			t.Errorf("barrier ran with %d finished and %d running, want 7 and 0", finished, running)
+		}
+		barrier = true
+	})
+	for i := 0; i < 4; i++ {
+		q.Add(ctx, work(1))
+	}
+	q.AddPriority(ctx, PriorityHigh, work(1))
+	<-q.Idle()
+
+	if !barrier || finished != 12 {
+		t.Errorf("barrier ran: %v, %d functions finished, want true and 12", barrier, finished)
+	}
+
+	// A barrier on an idle queue runs immediately.
+	done := make(chan struct{})
+	q.Barrier(ctx, func(context.Context) { close(done) })
+	<-done
+	<-q.Idle()
+}
+
+func TestQueueAddExclusive(t *testing.T) {
+	q, _ := NewQueue(2)
+	ctx := context.Background()
+	var (
+		mu        sync.Mutex
+		running   int
+		exclusive bool // whether the exclusive function is running
+		order     []string
+	)
+	unblock := make(chan struct{})
+	work := func(name string, wait <-chan struct{}) func(context.Context) {
+		return func(context.Context) {
+			mu.Lock()
+			if exclusive {
+				t.Errorf("%s started while the exclusive function ran", name)
+			}
+			running++
+			order = append(order, name)
+			mu.Unlock()
+			if wait != nil {
+				<-wait
+			}
+			time.Sleep(2 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}
+	}
+
+	q.Add(ctx, work("active", unblock))
+	q.Add(ctx, work("active", unblock))
+	q.AddPriority(ctx, PriorityLow, work("low", nil))
+	q.AddExclusive(ctx, func(context.Context) {
+		mu.Lock()
+		if running != 0 {
+			t.Errorf("exclusive function started with %d others running", running)
+		}
+		exclusive = true
+		order = append(order, "exclusive")
+		mu.Unlock()
+		time.Sleep(2 * time.Millisecond)
+		mu.Lock()
+		exclusive = false
+		mu.Unlock()
+	})
+	q.Add(ctx, work("after", nil))
+	q.Add(ctx, work("after", nil))
+	close(unblock)
+	<-q.Idle()
+
+	// Unlike a barrier, the exclusive function does not wait for the
+	// low-priority function submitted before it.
+	want := "active,active,exclusive,after,after,low"
+	if got := strings.Join(order, ","); got != want {
+		t.Errorf("ran %s, want %s", got, want)
+	}
+}
+
+func TestQueueIdleBeforeAdd(t *testing.T) {
+	q, _ := NewQueue(1)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-q.Idle():
+			case <-time.After(time.Second):
+				t.Errorf("Idle on a new queue blocked")
+			}
+		}()
+	}
+	wg.Wait()
+	if first, second := q.Idle(), q.Idle(); first != second {
+		t.Errorf("repeated Idle calls on an idle queue returned different channels")
+	}
+
+	// The queue still reports busy and idle correctly afterwards.
+	unblock := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { <-unblock })
+	select {
+	case <-q.Idle():
+		t.Errorf("Idle closed while a function was running")
+	default:
+	}
+	close(unblock)
+	<-q.Idle()
+}
+
+func TestQueueAddRecursive(t *testing.T) {
+	q, _ := NewQueue(2)
+	var (
+		mu    sync.Mutex
+		nodes int
+	)
+	var node func(depth int) func(context.Context, *Queue)
+	node = func(depth int) func(context.Context, *Queue) {
+		return func(ctx context.Context, q *Queue) {
+			mu.Lock()
+			nodes++
+			mu.Unlock()
+			if depth == 0 {
+				return
+			}
+			q.AddRecursive(ctx, node(depth-1))
+			q.AddRecursive(ctx, node(depth-1))
+		}
+	}
+	q.AddRecursive(context.Background(), node(4))
+	if !q.WaitTimeout(time.Second) {
+		t.Fatalf("task tree did not finish")
+	}
+	if nodes != 31 {
+		t.Errorf("%d nodes ran, want 31", nodes)
+	}
+}
+
+func TestQueueUtilization(t *testing.T) {
+	q, _ := NewQueue(4)
+	if u := q.Utilization(); u != 0 {
+		t.Errorf("Utilization of idle queue = %v, want 0", u)
+	}
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		q.Add(ctx, func(context.Context) { <-unblock })
+	}
+	if u := q.Utilization(); u != 0.75 {
+		t.Errorf("Utilization = %v, want 0.75", u)
+	}
+	q.SetMaxActive(2)
+	if u := q.Utilization(); u != 1 {
+		t.Errorf("Utilization above a lowered limit = %v, want 1", u)
+	}
+	close(unblock)
+	<-q.Idle()
+}
+
+func TestQueueCancelGroup(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.AddLabeled(ctx, "op", func(context.Context) { <-unblock })
+
+	ran := make(chan string, 10)
+	for _, label := range []string{"op", "other", "op", "op", "other"} {
+		q.AddLabeled(ctx, label, func(context.Context) { ran <- label })
+	}
+	if n := q.CancelGroup("op"); n != 3 {
+		t.Errorf("CancelGroup removed %d functions, want 3", n)
+	}
+	if n := q.CancelGroup("op"); n != 0 {
+		t.Errorf("second CancelGroup removed %d functions, want 0", n)
+	}
+	if got := strings.Join(q.PeekLabels(), ","); got != "other,other" {
+		t.Errorf("PeekLabels after CancelGroup = %q, want other,other", got)
+	}
+	close(unblock)
+	<-q.Idle()
+	close(ran)
+	for label := range ran {
+		if label != "other" {
+			t.Errorf("canceled function with label %q ran", label)
+		}
+	}
+}
+
+func TestQueueWaitBacklogBelow(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	steps := make(chan struct{})
+	for i := 0; i < 3; i++ {
+		q.Add(ctx, func(context.Context) { <-steps })
+	}
+
+	if err := q.WaitBacklogBelow(ctx, 4); err != nil {
+		t.Errorf("WaitBacklogBelow above the backlog length returned %v", err)
+	}
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := q.WaitBacklogBelow(short, 3); err != context.DeadlineExceeded {
+		t.Errorf("WaitBacklogBelow on a full backlog returned %v, want DeadlineExceeded", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- q.WaitBacklogBelow(ctx, 2) }()
+	close(unblock)
+	select {
+	case err := <-done:
+		t.Fatalf("WaitBacklogBelow returned %v with 2 functions backlogged", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	steps <- struct{}{}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WaitBacklogBelow returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("WaitBacklogBelow did not return once the backlog shrank")
+	}
+	if n := q.BacklogLen(); n >= 2 {
+		t.Errorf("BacklogLen = %d after WaitBacklogBelow(2)", n)
+	}
+	close(steps)
+	<-q.Idle()
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := q.WaitBacklogBelow(canceled, 0); err != context.Canceled {
+		t.Errorf("WaitBacklogBelow(0) returned %v, want Canceled", err)
+	}
+}
+
+func TestQueueSubmit(t *testing.T) {
+	q, _ := NewBoundedQueue(1, 1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	if s := q.Submit(ctx, func(context.Context) { <-unblock }); s != (Submission{Seq: 1, Started: true}) {
+		t.Errorf("first Submit = %+v, want {Seq:1 Started:true}", s)
+	}
+	if s := q.Submit(ctx, func(context.Context) {}); s != (Submission{Seq: 2}) {
+		t.Errorf("backlogged Submit = %+v, want {Seq:2 Started:false}", s)
+	}
+	if s := q.Submit(ctx, func(context.Context) {}); s != (Submission{}) {
+		t.Errorf("rejected Submit = %+v, want zero Submission", s)
+	}
+	close(unblock)
+	<-q.Idle()
+}
+
+func TestQueueAddWaitFromRunningFunction(t *testing.T) {
+	q, _ := NewQueue(2)
+	ctx := context.Background()
+	errs := make(chan error, 2)
+	unblock := make(chan struct{})
+	q.Add(ctx, func(ctx context.Context) {
+		// One slot is free, so this starts at once.
+		errs <- q.AddWait(ctx, func(context.Context) { <-unblock })
+		// Both slots are now busy: waiting here could never end.
+		errs <- q.AddWait(ctx, func(context.Context) {})
+	})
+	if err := <-errs; err != nil {
+		t.Errorf("AddWait with a free slot returned %v", err)
+	}
+	select {
+	case err := <-errs:
+		if err != ErrWouldDeadlock {
+			t.Errorf("AddWait with every slot busy returned %v, want ErrWouldDeadlock", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("AddWait from a running function blocked")
+	}
+	close(unblock)
+	<-q.Idle()
+	if n := q.Completed(); n != 2 {
+		t.Errorf("Completed = %d, want 2: the rejected function must not run", n)
+	}
+}
+
+func TestQueueAddWithCancel(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	started := make(chan struct{})
+	canceled := make(chan error, 1)
+	runCtx, cancel := q.AddWithCancel(ctx, func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		canceled <- ctx.Err()
+	})
+	<-started
+
+	ran := make(chan struct{})
+	backlogged, cancelBacklogged := q.AddWithCancel(ctx, func(context.Context) { close(ran) })
+	if n := q.BacklogLen(); n != 1 {
+		t.Fatalf("BacklogLen = %d, want 1", n)
+	}
+	cancelBacklogged()
+	cancelBacklogged()
+	if n := q.BacklogLen(); n != 0 {
+		t.Errorf("BacklogLen = %d after cancel, want 0", n)
+	}
+	if backlogged.Err() == nil {
+		t.Errorf("run context of a withdrawn function not cancelled")
+	}
+
+	if runCtx.Err() != nil {
+		t.Fatalf("run context cancelled while its function runs")
+	}
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("running function saw %v, want Canceled", err)
+	}
+	<-q.Idle()
+	select {
+	case <-ran:
+		t.Errorf("withdrawn function ran")
+	default:
+	}
+
+	done, _ := q.AddWithCancel(ctx, func(context.Context) {})
+	<-q.Idle()
+	if done.Err() == nil {
+		t.Errorf("run context not released after its function returned")
+	}
+}
+
+func TestQueueSubmissionErrors(t *testing.T) {
+	f := func(context.Context) {}
+	submitters := map[string]func(context.Context, *Queue) error{
+		"Enqueue": func(ctx context.Context, q *Queue) error { return q.Enqueue(ctx, f) },
+		"AddWait": func(ctx context.Context, q *Queue) error { return q.AddWait(ctx, f) },
+		"AddWaitTimeout": func(ctx context.Context, q *Queue) error {
+			return q.AddWaitTimeout(ctx, time.Second, f)
+		},
+		"SubmitAndWait": func(ctx context.Context, q *Queue) error { return q.SubmitAndWait(ctx, f) },
+		// ErrDraining and ErrClosed take precedence over ErrTooHeavy.
+		"AddWeighted": func(ctx context.Context, q *Queue) error { return q.AddWeighted(ctx, 5, f) },
+	}
+	for _, tc := range []struct {
+		state string
+		stop  func(*Queue)
+		want  error
+	}{
+		{"draining", func(q *Queue) { q.Drain(context.Background()) }, ErrDraining},
+		{"closed", func(q *Queue) { q.Close() }, ErrClosed},
+		{"shut down", func(q *Queue) { q.ShutdownNow() }, ErrClosed},
+	} {
+		for name, submit := range submitters {
+			q, _ := NewQueue(1)
+			tc.stop(q)
+			if err := submit(context.Background(), q); !errors.Is(err, tc.want) {
+				t.Errorf("%s on a %s queue returned %v, want %v", name, tc.state, err, tc.want)
+			}
+		}
+	}
+}
+
+func TestNewSerialQueue(t *testing.T) {
+	q := NewSerialQueue()
+	ctx := context.Background()
+	var running atomic.Int32
+	var got []int
+	for i := 0; i < 50; i++ {
+		q.Add(ctx, func(context.Context) {
+			if running.Add(1) != 1 {
+				t.Errorf("function %d overlapped another", i)
+			}
+			runtime.Gosched()
+			got = append(got, i)
+			running.Add(-1)
+		})
+	}
+	<-q.Idle()
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("serial queue ran %v, want FIFO order", got)
+		}
+	}
+	if err := q.SetMaxActive(2); err == nil {
+		t.Errorf("SetMaxActive(2) on a serial queue succeeded")
+	}
+}
+
+func TestQueueNilFunc(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	for name, submit := range map[string]func(){
+		"Add":       func() { q.Add(ctx, nil) },
+		"AddSimple": func() { q.AddSimple(nil) },
+		"AddErr":    func() { q.AddErr(ctx, nil) },
+		"Enqueue":   func() { q.Enqueue(ctx, nil) },
+		"AddWait":   func() { q.AddWait(ctx, nil) },
+		"AddAfter":  func() { q.AddAfter(ctx, time.Hour, nil) },
+		"AddAll":    func() { q.AddAll(ctx, []func(context.Context){func(context.Context) {}, nil}) },
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r != nilFunc {
+					t.Errorf("%s with a nil function: recovered %v, want %q", name, r, nilFunc)
+				}
+			}()
+			submit()
+		}()
+	}
+	if seq := q.AddSeq(ctx, func(context.Context) {}); seq != 1 {
+		t.Errorf("first accepted function got sequence number %d, want 1", seq)
+	}
+	<-q.Idle()
+}
+
+func TestYield(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	var got []string
+	unblock := make(chan struct{})
+	q.Add(ctx, func(ctx context.Context) {
+		<-unblock
+		got = append(got, "long 1")
+		if err := Yield(ctx, func(context.Context) { got = append(got, "long 2") }); err != nil {
+			t.Errorf("Yield returned %v", err)
+		}
+	})
+	q.Add(ctx, func(context.Context) { got = append(got, "short") })
+	close(unblock)
+	<-q.Idle()
+
+	if s := strings.Join(got, ","); s != "long 1,short,long 2" {
+		t.Errorf("ran %s, want long 1,short,long 2", s)
+	}
+	if err := Yield(ctx, func(context.Context) {}); err != ErrNotRunning {
+		t.Errorf("Yield outside a running function returned %v, want ErrNotRunning", err)
+	}
+}
+
+func TestQueueClearBacklog(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+	ran := make(chan struct{}, 3)
+	errs := make(chan error, 1)
+	for i := 0; i < 2; i++ {
+		q.Add(ctx, func(context.Context) { ran <- struct{}{} })
+	}
+	go func() { errs <- q.SubmitAndWait(ctx, func(context.Context) { ran <- struct{}{} }) }()
+	for q.BacklogLen() != 3 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := q.ClearBacklog(); n != 3 {
+		t.Errorf("ClearBacklog discarded %d functions, want 3", n)
+	}
+	if err := <-errs; err != ErrCanceled {
+		t.Errorf("SubmitAndWait of a cleared function returned %v, want ErrCanceled", err)
+	}
+	if n := q.ClearBacklog(); n != 0 {
+		t.Errorf("second ClearBacklog discarded %d functions, want 0", n)
+	}
+	q.Add(ctx, func(context.Context) { ran <- struct{}{} })
+	close(unblock)
+	<-q.Idle()
+	if n := len(ran); n != 1 {
+		t.Errorf("%d functions ran, want only the one added after ClearBacklog", n)
+	}
+}
+
+func TestQueueCompletions(t *testing.T) {
+	q, _ := NewQueue(2)
+	ctx := context.Background()
+	completions := q.Completions()
+	if q.Completions() != completions {
+		t.Errorf("Completions returned different channels")
+	}
+	for i := 0; i < 5; i++ {
+		q.Add(ctx, func(context.Context) {})
+	}
+	for i := 0; i < 5; i++ {
+		select {
+		case <-completions:
+		case <-time.After(time.Second):
+			t.Fatalf("received %d completions, want 5", i)
+		}
+	}
+
+	// A receiver that falls behind loses completions instead of blocking
+	// the Queue.
+	for i := 0; i < completionsBuffer+10; i++ {
+		q.Add(ctx, func(context.Context) {})
+	}
+	<-q.Idle()
+	if n := len(completions); n != completionsBuffer {
+		t.Errorf("%d completions buffered, want %d", n, completionsBuffer)
+	}
+}
+
+func TestQueueAddCallback(t *testing.T) {
+	q, _ := NewQueue(1)
+	ctx := context.Background()
+	type result struct {
+		v   any
+		err error
+	}
+	results := make(chan result, 1)
+	cb := func(v any, err error) { results <- result{v, err} }
+	boom := errors.New("boom")
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		f    func(context.Context) (any, error)
+		want result
+	}{
+		{"value", ctx, func(context.Context) (any, error) { return 42, nil }, result{42, nil}},
+		{"error", ctx, func(context.Context) (any, error) { return nil, boom }, result{nil, boom}},
+		{"panic", ctx, func(context.Context) (any, error) { panic("oops") }, result{nil, ErrPanicked}},
+		{"canceled", canceled, func(context.Context) (any, error) { return 1, nil }, result{nil, context.Canceled}},
+	} {
+		unblock := make(chan struct{})
+		q.Add(ctx, func(context.Context) { <-unblock })
+		q.AddCallback(tc.ctx, tc.f, cb)
+		close(unblock)
+		select {
+		case got := <-results:
+			if got != tc.want {
+				t.Errorf("%s: callback got %v, want %v", tc.name, got, tc.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: callback not called", tc.name)
+		}
+		<-q.Idle()
+	}
+
+	q.Close()
+	q.AddCallback(ctx, func(context.Context) (any, error) { return 1, nil }, cb)
+	if got := <-results; got.err != ErrClosed {
+		t.Errorf("callback for a rejected function got %v, want ErrClosed", got.err)
+	}
+}
+
+func TestQueueActiveInvariant(t *testing.T) {
+	const limit = 4
+	q, _ := NewQueue(limit)
+	ctx := context.Background()
+	var running atomic.Int32
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if n := q.ActiveCount(); n < 0 || n > limit {
+				t.Errorf("ActiveCount = %d, want 0..%d", n, limit)
+				return
+			}
+			runtime.Gosched()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				q.Add(ctx, func(context.Context) {
+					if n := running.Add(1); n > limit {
+						t.Errorf("%d functions running, limit %d", n, limit)
+					}
+					runtime.Gosched()
+					running.Add(-1)
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	<-q.Idle()
+	close(stop)
+	<-sampled
+	if n := q.ActiveCount(); n != 0 {
+		t.Errorf("ActiveCount = %d once idle, want 0", n)
+	}
+
+	// Freeing slots that are not occupied must not pass unnoticed.
+	defer func() {
+		if recover() == nil {
+			t.Errorf("release with no active functions did not panic")
+		}
+	}()
+	st := queueState{}
+	st.release(&task{})
+}
+
+func TestQueueAddN(t *testing.T) {
+	q, _ := NewQueue(1)
+	var got []int
+	q.AddN(context.Background(), 5, func(_ context.Context, i int) { got = append(got, i) })
+	<-q.Idle()
+	if len(got) != 5 {
+		t.Fatalf("AddN ran %v, want 0..4", got)
+	}
+	for i, n := range got {
+		if n != i {
+			t.Fatalf("AddN ran %v, want 0..4 in order", got)
+		}
+	}
+}
+
+func TestNewQueueWithContextIdleOnCancel(t *testing.T) {
+	root, cancel := context.WithCancel(context.Background())
+	q, _ := NewQueueWithContext(root, 1)
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	defer close(unblock)
+	q.Add(ctx, func(context.Context) { <-unblock })
+	q.Add(ctx, func(context.Context) {})
+	idle := q.Idle()
+
+	cancel()
+	select {
+	case <-idle:
+	case <-time.After(time.Second):
+		t.Fatalf("Idle did not fire after the root context was cancelled")
+	}
+	if !q.IsIdle() {
+		t.Errorf("terminated queue with a running function is not idle")
+	}
+	if err := q.Wait(ctx); err != nil {
+		t.Errorf("Wait on a terminated queue returned %v", err)
+	}
+}
+
+func TestQueueActiveSnapshot(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	q, _ := NewQueueWithOptions(2, WithClock(clock))
+	ctx := context.Background()
+	if s := q.ActiveSnapshot(); len(s) != 0 {
+		t.Errorf("ActiveSnapshot of a new queue = %v, want empty", s)
+	}
+	unblock := make(chan struct{})
+	q.AddLabeled(ctx, "first", func(context.Context) { <-unblock })
+	clock.advance(time.Second)
+	q.Add(ctx, func(context.Context) { <-unblock })
+	q.AddLabeled(ctx, "waiting", func(context.Context) {})
+
+	want := []ActiveTask{
+		{Seq: 1, Label: "first", Started: time.Unix(1000, 0)},
+		{Seq: 2, Started: time.Unix(1001, 0)},
+	}
+	got := q.ActiveSnapshot()
+	if len(got) != len(want) {
+		t.Fatalf("ActiveSnapshot = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("ActiveSnapshot()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+	close(unblock)
+	<-q.Idle()
+}
@@ -0,0 +1,41 @@
+package goqueue
+
+import "time"
+
+// rateLimiter is a token bucket that limits how often a Queue starts
+// functions. Each start reserves a token; when the bucket is empty the
+// reservation is granted in the future and the task waits for it.
+type rateLimiter struct {
+	interval time.Duration // time to earn one token
+	burst    float64
+	tokens   float64 // negative when future tokens are already reserved
+	last     time.Time
+}
+
+func newRateLimiter(n int, per time.Duration, now time.Time) *rateLimiter {
+	return &rateLimiter{
+		interval: per / time.Duration(n),
+		burst:    float64(n),
+		tokens:   float64(n),
+		last:     now,
+	}
+}
+
+// reserve takes a token and returns how long after now the caller must
+// wait before using it.
+func (l *rateLimiter) reserve(now time.Time) time.Duration {
+	if l.interval <= 0 {
+		return 0
+	}
+	l.tokens += float64(now.Sub(l.last)) / float64(l.interval)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens * float64(l.interval))
+}
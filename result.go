@@ -0,0 +1,94 @@
+package goqueue
+
+import "context"
+
+// ResultQueue is a concurrency-limited FIFO work queue for functions that
+// produce a value of type T.
+//
+// A ResultQueue has the same concurrency and ordering semantics as Queue,
+// which it uses to run its functions. Each submission returns a Task from
+// which the result can be retrieved.
+//
+// ResultQueue is safe for concurrent use by multiple goroutines.
+type ResultQueue[T any] struct {
+	q *Queue
+}
+
+// NewResultQueue creates a new ResultQueue that allows at most maxActive
+// functions to run concurrently.
+//
+// maxActive must be greater than zero. If maxActive is less than 1,
+// NewResultQueue returns an error.
+func NewResultQueue[T any](maxActive int) (*ResultQueue[T], error) {
+	q, err := NewQueue(maxActive)
+	if err != nil {
+		return nil, err
+	}
+	return &ResultQueue[T]{q: q}, nil
+}
+
+// Queue returns the Queue that runs rq's functions.
+func (rq *ResultQueue[T]) Queue() *Queue {
+	return rq.q
+}
+
+// Add submits a function to the ResultQueue for execution and returns a
+// Task for its result.
+//
+// Add behaves like Queue.Add. If f is discarded without running, because
+// the queue rejects it, because ctx is done before it leaves the backlog,
+// or because the backlog is cancelled, the Task completes with the
+// corresponding error. If f panics, the Task completes with ErrPanicked.
+func (rq *ResultQueue[T]) Add(ctx context.Context, f func(context.Context) (T, error)) *Task[T] {
+	if f == nil {
+		panic(nilFunc)
+	}
+	t := &Task[T]{done: make(chan struct{})}
+	_, err := rq.q.add(&task{
+		ctx: ctx,
+		f: func(ctx context.Context) {
+			defer close(t.done)
+			t.err = ErrPanicked
+			t.val, t.err = f(ctx)
+		},
+		x: &taskExtra{dropped: t.fail},
+	})
+	if err != nil {
+		t.fail(err)
+	}
+	return t
+}
+
+// Task is the pending result of a function submitted to a ResultQueue.
+type Task[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+}
+
+// fail completes t with err and no value.
+func (t *Task[T]) fail(err error) {
+	t.err = err
+	close(t.done)
+}
+
+// Done returns a channel that is closed when the task's result is
+// available.
+func (t *Task[T]) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait blocks until the task completes and returns the value and error
+// produced by its function, or the reason it did not run.
+//
+// If ctx is done first, Wait returns the zero value and ctx.Err(); the
+// task itself is unaffected.
+func (t *Task[T]) Wait(ctx context.Context) (T, error) {
+	select {
+	case <-t.done:
+		return t.val, t.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
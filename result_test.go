@@ -0,0 +1,65 @@
+package goqueue
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestResultQueue(t *testing.T) {
+	rq, _ := NewResultQueue[int](2)
+	ctx := context.Background()
+
+	tasks := make([]*Task[int], 5)
+	for i := range tasks {
+		tasks[i] = rq.Add(ctx, func(context.Context) (int, error) {
+			return i * i, nil
+		})
+	}
+	for i, task := range tasks {
+		v, err := task.Wait(ctx)
+		if err != nil || v != i*i {
+			t.Errorf("task %d: Wait() = %d, %v; want %d, nil", i, v, err, i*i)
+		}
+	}
+
+	errBoom := errors.New("boom")
+	_, err := rq.Add(ctx, func(context.Context) (int, error) {
+		return 0, errBoom
+	}).Wait(ctx)
+	if err != errBoom {
+		t.Errorf("Wait() error = %v, want %v", err, errBoom)
+	}
+}
+
+func TestResultQueueDropped(t *testing.T) {
+	rq, _ := NewResultQueue[string](1)
+	unblock := make(chan struct{})
+	rq.Add(context.Background(), func(context.Context) (string, error) {
+		<-unblock
+		return "", nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	task := rq.Add(ctx, func(context.Context) (string, error) {
+		t.Errorf("function run after its context was cancelled")
+		return "", nil
+	})
+	cancel()
+	close(unblock)
+
+	if _, err := task.Wait(context.Background()); err != context.Canceled {
+		t.Errorf("Wait() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestResultQueuePanic(t *testing.T) {
+	rq, _ := NewResultQueue[int](1)
+	ctx := context.Background()
+	_, err := rq.Add(ctx, func(context.Context) (int, error) {
+		panic("boom")
+	}).Wait(ctx)
+	if err != ErrPanicked {
+		t.Errorf("Wait() error = %v, want %v", err, ErrPanicked)
+	}
+}
@@ -0,0 +1,145 @@
+package goqueue
+
+import "time"
+
+// A Scheduler decides the order in which backlogged functions start,
+// replacing the Queue's built-in ordering by priority and Ordering.
+// Install one with WithScheduler.
+//
+// The Queue calls a Scheduler's methods only while holding its internal
+// lock, so a Scheduler need not be safe for concurrent use, but its
+// methods must be fast and must not call back into the Queue.
+type Scheduler interface {
+	// Push adds a function that is ready to start.
+	Push(p *Pending)
+	// Pop removes and returns the function that should start next, or
+	// nil if there is none.
+	Pop() *Pending
+	// Len returns the number of functions pushed and not yet popped.
+	Len() int
+}
+
+// A Pending describes a backlogged function to a Scheduler.
+type Pending struct {
+	Seq      int64     // sequence number, as returned by AddSeq
+	Priority Priority  // priority given to AddPriority
+	Label    string    // label given to AddLabeled; empty otherwise
+	Enqueued time.Time // when the function entered the backlog
+	Deadline time.Time // deadline of its context; zero if it has none
+
+	t *task
+}
+
+// NewFIFOScheduler returns a Scheduler that starts functions in the order
+// they were pushed, regardless of priority.
+func NewFIFOScheduler() Scheduler {
+	return &fifoScheduler{}
+}
+
+type fifoScheduler struct {
+	items []*Pending
+}
+
+func (s *fifoScheduler) Push(p *Pending) { s.items = append(s.items, p) }
+
+func (s *fifoScheduler) Pop() *Pending {
+	if len(s.items) == 0 {
+		return nil
+	}
+	p := s.items[0]
+	s.items[0] = nil
+	s.items = s.items[1:]
+	return p
+}
+
+func (s *fifoScheduler) Len() int { return len(s.items) }
+
+// NewLIFOScheduler returns a Scheduler that starts the most recently
+// pushed function first, regardless of priority.
+func NewLIFOScheduler() Scheduler {
+	return &lifoScheduler{}
+}
+
+type lifoScheduler struct {
+	items []*Pending
+}
+
+func (s *lifoScheduler) Push(p *Pending) { s.items = append(s.items, p) }
+
+func (s *lifoScheduler) Pop() *Pending {
+	n := len(s.items)
+	if n == 0 {
+		return nil
+	}
+	p := s.items[n-1]
+	s.items[n-1] = nil
+	s.items = s.items[:n-1]
+	return p
+}
+
+func (s *lifoScheduler) Len() int { return len(s.items) }
+
+// With a Scheduler, a backlog keeps every task in its all list, in
+// submission order, and hands the ready ones to the Scheduler. Tasks held
+// back by a Barrier are handed over once it releases them, from
+// unscheduled onwards. A task removed from the backlog stays in the
+// Scheduler until popped, and is then skipped.
+
+// schedPush adds t, which has just been submitted, to b's Scheduler.
+func (b *backlog) schedPush(t *task) {
+	b.all.pushBack(t)
+	if b.unscheduled != nil || t.gen > b.gen {
+		if b.unscheduled == nil {
+			b.unscheduled = t
+		}
+		return
+	}
+	b.schedule(t)
+}
+
+// schedule hands t to b's Scheduler.
+func (b *backlog) schedule(t *task) {
+	p := &Pending{Seq: t.seq, Priority: t.priority, Label: t.label(), Enqueued: t.since, t: t}
+	if d, ok := t.ctx.Deadline(); ok {
+		p.Deadline = d
+	}
+	b.sched.Push(p)
+}
+
+// schedPeek returns the task the Scheduler would start next, or the
+// oldest held-back task if it has none.
+func (b *backlog) schedPeek() *task {
+	for b.head == nil && b.sched.Len() > 0 {
+		p := b.sched.Pop()
+		if p == nil {
+			break
+		}
+		if p.t.backlogged {
+			b.head = p.t
+		}
+	}
+	if b.head != nil {
+		return b.head
+	}
+	return b.unscheduled
+}
+
+// schedRemove unlinks t from b's lists.
+func (b *backlog) schedRemove(t *task) {
+	if b.unscheduled == t {
+		b.unscheduled = t.next
+	}
+	if b.head == t {
+		b.head = nil
+	}
+	b.all.remove(t)
+}
+
+// schedRelease hands the tasks of generation gen and earlier that were
+// held back to b's Scheduler.
+func (b *backlog) schedRelease(gen int64) {
+	for t := b.unscheduled; t != nil && t.gen <= gen; t = t.next {
+		b.schedule(t)
+		b.unscheduled = t.next
+	}
+}
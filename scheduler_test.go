@@ -0,0 +1,102 @@
+package goqueue
+
+import (
+	"container/heap"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// edfScheduler starts the function with the earliest deadline first.
+type edfScheduler []*Pending
+
+func (s edfScheduler) Len() int           { return len(s) }
+func (s edfScheduler) Less(i, j int) bool { return s[i].Deadline.Before(s[j].Deadline) }
+func (s edfScheduler) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s *edfScheduler) Push(x any)        { *s = append(*s, x.(*Pending)) }
+func (s *edfScheduler) Pop() any {
+	old := *s
+	p := old[len(old)-1]
+	*s = old[:len(old)-1]
+	return p
+}
+
+// edf adapts edfScheduler to the Scheduler interface.
+type edf struct{ h edfScheduler }
+
+func (e *edf) Push(p *Pending) { heap.Push(&e.h, p) }
+func (e *edf) Len() int        { return e.h.Len() }
+func (e *edf) Pop() *Pending {
+	if e.h.Len() == 0 {
+		return nil
+	}
+	return heap.Pop(&e.h).(*Pending)
+}
+
+func TestWithScheduler(t *testing.T) {
+	q, _ := NewQueueWithOptions(1, WithScheduler(&edf{}))
+	base := time.Now().Add(time.Hour)
+	unblock := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { <-unblock })
+
+	var got []string
+	var cancels []context.CancelFunc
+	for _, tc := range []struct {
+		name string
+		in   time.Duration
+	}{{"c", 3 * time.Minute}, {"a", time.Minute}, {"d", 4 * time.Minute}, {"b", 2 * time.Minute}} {
+		ctx, cancel := context.WithDeadline(context.Background(), base.Add(tc.in))
+		cancels = append(cancels, cancel)
+		name := tc.name
+		h := q.AddCancelable(ctx, func(context.Context) { got = append(got, name) })
+		if name == "d" {
+			h.Cancel()
+		}
+	}
+	close(unblock)
+	<-q.Idle()
+	for _, cancel := range cancels {
+		cancel()
+	}
+	if s := strings.Join(got, ","); s != "a,b,c" {
+		t.Errorf("EDF scheduler ran %s, want a,b,c", s)
+	}
+}
+
+func TestSchedulerBarrier(t *testing.T) {
+	q, _ := NewQueueWithOptions(1, WithScheduler(NewLIFOScheduler()))
+	ctx := context.Background()
+	unblock := make(chan struct{})
+	q.Add(ctx, func(context.Context) { <-unblock })
+
+	var got []string
+	add := func(name string) { q.Add(ctx, func(context.Context) { got = append(got, name) }) }
+	add("1")
+	add("2")
+	q.Barrier(ctx, func(context.Context) { got = append(got, "barrier") })
+	add("3")
+	add("4")
+	close(unblock)
+	<-q.Idle()
+
+	// LIFO within each side of the barrier, which still separates them.
+	if s := strings.Join(got, ","); s != "2,1,barrier,4,3" {
+		t.Errorf("ran %s, want 2,1,barrier,4,3", s)
+	}
+}
+
+func TestFIFOScheduler(t *testing.T) {
+	s := NewFIFOScheduler()
+	for i := int64(1); i <= 3; i++ {
+		s.Push(&Pending{Seq: i})
+	}
+	for i := int64(1); i <= 3; i++ {
+		if p := s.Pop(); p == nil || p.Seq != i {
+			t.Fatalf("Pop = %v, want Seq %d", p, i)
+		}
+	}
+	if p := s.Pop(); p != nil || s.Len() != 0 {
+		t.Errorf("empty FIFO scheduler returned %v with Len %d", p, s.Len())
+	}
+}
@@ -0,0 +1,67 @@
+package goqueue
+
+import "context"
+
+// Scope submits functions to a Queue on behalf of a context, typically
+// that of a request. Functions submitted through a Scope run with the
+// Scope's context, and are removed from the Queue's backlog as soon as
+// that context is done, so that no work runs for an abandoned request.
+type Scope struct {
+	q   *Queue
+	ctx context.Context
+
+	// tasks holds tasks submitted through the Scope that may still be
+	// backlogged. It is guarded by the Queue's state.
+	tasks []*task
+}
+
+// Scope returns a Scope that submits functions to q with ctx.
+func (q *Queue) Scope(ctx context.Context) *Scope {
+	s := &Scope{q: q, ctx: ctx}
+	context.AfterFunc(ctx, s.end)
+	return s
+}
+
+// Add submits f to the Queue, as by Add, with the Scope's context. If
+// that context is already done, f is discarded.
+func (s *Scope) Add(f func(context.Context)) {
+	if f == nil {
+		panic(nilFunc)
+	}
+	t := &task{ctx: s.ctx, f: f}
+	st := <-s.q.st
+	defer func() { s.q.unlock(st) }()
+	if s.ctx.Err() != nil {
+		return
+	}
+	if queued, _ := s.q.submit(&st, t); queued {
+		s.track(t)
+	}
+}
+
+// track records that t is backlogged. The caller must hold the state.
+func (s *Scope) track(t *task) {
+	if len(s.tasks) == cap(s.tasks) {
+		// Forget tasks that have since left the backlog before growing.
+		live := s.tasks[:0]
+		for _, t := range s.tasks {
+			if t.backlogged {
+				live = append(live, t)
+			}
+		}
+		clear(s.tasks[len(live):])
+		s.tasks = live
+	}
+	s.tasks = append(s.tasks, t)
+}
+
+// end removes the Scope's backlogged functions once its context is done.
+func (s *Scope) end() {
+	st := <-s.q.st
+	defer func() { s.q.st <- st }()
+	for _, t := range s.tasks {
+		st.backlog.remove(t)
+	}
+	s.tasks = nil
+	st.signalIdle()
+}
@@ -0,0 +1,39 @@
+package goqueue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestQueueScope(t *testing.T) {
+	q, _ := NewQueue(1)
+	unblock := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { <-unblock })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	scope := q.Scope(ctx)
+	for i := 0; i < 3; i++ {
+		scope.Add(func(context.Context) { t.Errorf("function of ended scope ran") })
+	}
+	ran := make(chan struct{})
+	q.Add(context.Background(), func(context.Context) { close(ran) })
+	if n := q.BacklogLen(); n != 4 {
+		t.Errorf("BacklogLen = %d, want 4", n)
+	}
+
+	// The scope's functions are removed as soon as ctx is done, without
+	// waiting for them to reach the front of the backlog.
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for q.BacklogLen() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := q.BacklogLen(); n != 1 {
+		t.Errorf("BacklogLen after scope ended = %d, want 1", n)
+	}
+	scope.Add(func(context.Context) { t.Errorf("function added to ended scope ran") })
+	close(unblock)
+	<-ran
+	<-q.Idle()
+}